@@ -10,6 +10,7 @@ const (
 	STAY
 	PICKUP
 	CLEAR
+	CHARGE
 	COUNT
 )
 
@@ -29,8 +30,20 @@ func (action Action) ToStr() string {
 		return "PICKUP"
 	case CLEAR:
 		return "CLEAR"
+	case CHARGE:
+		return "CHARGE"
 	}
 	return "UNKNOWN"
 }
 
+// FromStr は ToStr の逆変換で、s が行動の名前でない場合は false を返す
+func FromStr(s string) (Action, bool) {
+	for action := UP; action < COUNT; action++ {
+		if action.ToStr() == s {
+			return action, true
+		}
+	}
+	return COUNT, false
+}
+
 type Actions []Action
@@ -9,32 +9,60 @@ import (
 )
 
 type State struct {
-	Pos     mapdata.Pos
-	HasItem bool
+	Pos      mapdata.Pos `json:"pos"`
+	NumItems int         `json:"numItems"`          // 運んでいるアイテムの数
+	Battery  int         `json:"battery,omitempty"` // バッテリー残量 (バッテリーのモデルを使わない場合は常に 0)
 }
 
 type States []State
 
-func Next(states States, actions agentaction.Actions, ignore []bool, items []map[mapdata.Pos]int, mapData *mapdata.MapData, config *config.Config, randGen *rand.Rand, newItemProb float64) (States, []float64, []bool) {
+// Next は states で各エージェントが actions を行った後の状態と報酬を返す
+// items は更新され、新しく出現したアイテムの位置 (出現しなかったエージェントは NonePos) と、
+// 各エージェントが衝突したかどうかも返す
+func Next(states States, actions agentaction.Actions, ignore []bool, items []map[mapdata.Pos]int, mapData *mapdata.MapData, config *config.Config, randGen *rand.Rand, newItemProb float64) (States, []float64, []mapdata.Pos, []bool) {
 	var curPos []mapdata.Pos
-	var hasItem []bool
+	var numItems []int
+	var battery []int
 	for _, state := range states {
 		curPos = append(curPos, state.Pos)
-		hasItem = append(hasItem, state.HasItem)
+		numItems = append(numItems, state.NumItems)
+		battery = append(battery, state.Battery)
 	}
 	n := len(states)
 	nxtStates := make(States, n)
 	rewards := make([]float64, n)
-	newItem := make([]bool, n)
-	nxtPos, collision := NextPos(curPos, actions, ignore, mapData)
+	newItem := make([]mapdata.Pos, n)
+	// バッテリーが切れたエージェントは移動できない
+	moveActions := actions
+	if config.BatteryEnabled() {
+		moveActions = make(agentaction.Actions, n)
+		for i, action := range actions {
+			moveActions[i] = action
+			if battery[i] <= 0 {
+				moveActions[i] = agentaction.STAY
+			}
+		}
+	}
+	nxtPos, collision := NextPos(curPos, moveActions, ignore, mapData)
 	for i := range states {
+		if config.BatteryEnabled() && nxtPos[i] != curPos[i] {
+			battery[i] -= config.MoveBatteryCost(numItems[i])
+			if battery[i] < 0 {
+				battery[i] = 0
+			}
+		}
+		// 充電器のない位置でのバッテリー切れはそれ以降の報酬を失うため、プランナーが避けるように罰を与える
+		// 充電器の上で切れた場合は次のターンから充電できるので罰を与えない
+		if config.BatteryEnabled() && battery[i] == 0 && !mapData.IsCharger(nxtPos[i]) {
+			rewards[i] += config.BatteryDepletedPenalty()
+		}
 		if collision[i] {
 			rewards[i] += config.Penalty
 		}
 		switch actions[i] {
 		case agentaction.PICKUP:
-			if !hasItem[i] && items[i][curPos[i]] > 0 {
-				hasItem[i] = true
+			if numItems[i] < config.CarryCapacity() && items[i][curPos[i]] > 0 && CanPickUp(curPos[i], mapData, config) {
+				numItems[i]++
 				rewards[i] += config.Reward
 				items[i][curPos[i]]--
 				if items[i][curPos[i]] == 0 {
@@ -42,22 +70,51 @@ func Next(states States, actions agentaction.Actions, ignore []bool, items []map
 				}
 			}
 		case agentaction.CLEAR:
-			if hasItem[i] && curPos[i] == mapData.DepotPos {
-				hasItem[i] = false
-				rewards[i] += config.Reward
+			// 運んでいるアイテムをすべて降ろし、それぞれに報酬を与える
+			if numItems[i] > 0 && mapData.IsDepot(curPos[i]) {
+				rewards[i] += config.Reward * float64(numItems[i])
+				numItems[i] = 0
+			}
+		case agentaction.CHARGE:
+			if CanCharge(states[i], mapData, config) {
+				battery[i] += config.BatteryChargeRate()
+				if battery[i] > config.BatteryCapacity {
+					battery[i] = config.BatteryCapacity
+				}
 			}
 		}
+		newItem[i] = mapdata.NonePos
 		if randGen.Float64() < newItemProb {
-			newItemPos := mapData.AllPos[randGen.Intn(len(mapData.AllPos))]
-			newItem[i] = true
+			spawnPos := SpawnPos(mapData, config)
+			newItemPos := spawnPos[randGen.Intn(len(spawnPos))]
+			newItem[i] = newItemPos
 			items[i][newItemPos]++
 		}
 		nxtStates[i] = State{
-			Pos:     nxtPos[i],
-			HasItem: hasItem[i],
+			Pos:      nxtPos[i],
+			NumItems: numItems[i],
+			Battery:  battery[i],
 		}
 	}
-	return nxtStates, rewards, newItem
+	return nxtStates, rewards, newItem, collision
+}
+
+// SpawnPos はアイテムが出現しうる位置を返す
+func SpawnPos(mapData *mapdata.MapData, config *config.Config) []mapdata.Pos {
+	if config.ShelfPickOnly {
+		return mapData.PickPos
+	}
+	return mapData.AllPos
+}
+
+// CanPickUp は pos でアイテムを拾えるかどうかを返す
+func CanPickUp(pos mapdata.Pos, mapData *mapdata.MapData, config *config.Config) bool {
+	return !config.ShelfPickOnly || mapData.IsPickPos(pos)
+}
+
+// CanCharge は state で充電できるかどうかを返す
+func CanCharge(state State, mapData *mapdata.MapData, config *config.Config) bool {
+	return config.BatteryEnabled() && state.Battery < config.BatteryCapacity && mapData.IsCharger(state.Pos)
 }
 
 func NextPos(curPos []mapdata.Pos, actions agentaction.Actions, ignore []bool, mapData *mapdata.MapData) ([]mapdata.Pos, []bool) {
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"runtime"
+
+	"github.com/Div9851/new-warehouse-sim/config"
+	"github.com/Div9851/new-warehouse-sim/mapdata"
+	"github.com/Div9851/new-warehouse-sim/stats"
+)
+
+// totalClearRate は 1 回の実行の全エージェントを合わせたクリア率を返す
+func totalClearRate(outcome runOutcome) float64 {
+	items, clears := 0, 0
+	for i := range outcome.ItemsCount {
+		items += outcome.ItemsCount[i]
+		clears += outcome.ClearCount[i]
+	}
+	return float64(clears) / float64(items)
+}
+
+// runCompare は 2 つの設定を同じシードの列で実行し、クリア率の差 (B - A) を対応のある t 検定とブートストラップで評価する
+func runCompare(args []string) {
+	var (
+		flags         = flag.NewFlagSet("compare", flag.ExitOnError)
+		Run           = flags.Int("run", 10, "number of paired runs")
+		parallel      = flags.Int("parallel", runtime.NumCPU(), "maximum number of runs executed at the same time")
+		level         = flags.Float64("level", 0.95, "confidence level")
+		numResamples  = flags.Int("bootstrap", 10000, "number of bootstrap resamples (0 to disable)")
+		bootstrapSeed = flags.Int64("bootstrap-seed", 1, "random seed for bootstrap resampling")
+		inputs        inputOptions
+	)
+	inputs.addMapFlags(flags)
+	inputs.addSetFlag(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s compare [flags] a.json b.json\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *Run < 2 {
+		fatal(fmt.Errorf("-run must be at least 2 for a paired test"))
+	}
+	if *parallel < 1 {
+		fatal(fmt.Errorf("-parallel must be positive"))
+	}
+	if *level <= 0 || *level >= 1 {
+		fatal(fmt.Errorf("-level must be between 0 and 1"))
+	}
+
+	mapData, err := loadMapData(inputs.mapDataFile, &inputs.mapOpts)
+	if err != nil {
+		fatal(err)
+	}
+	paths := flags.Args()
+	configs := make([]*config.Config, 2)
+	maps := make([]*mapdata.MapData, 2)
+	oracles := newOracleCache(mapData)
+	for k, path := range paths {
+		if configs[k], err = inputs.loadConfig(path); err != nil {
+			fatal(err)
+		}
+		if err := inputs.check(mapData, configs[k]); err != nil {
+			fatal(err)
+		}
+		if maps[k], err = oracles.mapFor(configs[k]); err != nil {
+			fatal(err)
+		}
+	}
+	// 対にする実行は同じシードを使う
+	if configs[1].RandSeed != configs[0].RandSeed {
+		fmt.Fprintf(os.Stderr, "note: using randSeed %d of `%s` for `%s` too\n", configs[0].RandSeed, paths[0], paths[1])
+		configs[1].RandSeed = configs[0].RandSeed
+	}
+	for k := range paths {
+		printConfig(os.Stderr, fmt.Sprintf("config %c", 'A'+k), configs[k])
+	}
+
+	rates := make([]map[int]float64, 2)
+	for k := range paths {
+		fmt.Fprintf(os.Stderr, "=== %s ===\n", paths[k])
+		outcomes, _, interrupted := runPool(*Run, *parallel, os.Stderr, runner(maps[k], configs[k], *Run, false, ""))
+		if interrupted {
+			os.Exit(130)
+		}
+		rates[k] = make(map[int]float64)
+		for _, outcome := range outcomes {
+			rates[k][outcome.Run] = totalClearRate(outcome)
+		}
+	}
+	// 両方が成功し、クリア率が定まる実行だけを対にする
+	var a, b []float64
+	for run := 0; run < *Run; run++ {
+		rateA, okA := rates[0][run]
+		rateB, okB := rates[1][run]
+		if okA && okB && !math.IsNaN(rateA) && !math.IsNaN(rateB) {
+			a = append(a, rateA)
+			b = append(b, rateB)
+		}
+	}
+	test, err := stats.PairedT(a, b, *level)
+	if err != nil {
+		fatal(err)
+	}
+
+	pct := *level * 100
+	fmt.Println("--clear rate--")
+	for k, s := range [][]float64{a, b} {
+		w := stats.Of(s)
+		lo, hi := w.TInterval(*level)
+		fmt.Printf("%c (%s): avg. %f se. %f %g%% CI [%f, %f]\n", 'A'+k, paths[k], w.Mean(), w.StdErr(), pct, lo, hi)
+	}
+	fmt.Println("--difference (B - A)--")
+	fmt.Printf("PAIRS: %d\n", test.N)
+	fmt.Printf("MEAN: %f se. %f\n", test.MeanDiff, test.StdErr)
+	fmt.Printf("PAIRED T: %g%% CI [%f, %f] t = %f df = %g p = %g\n", pct, test.CILow, test.CIHigh, test.T, test.DF, test.P)
+	if *numResamples > 0 {
+		diffs := make([]float64, len(a))
+		for i := range a {
+			diffs[i] = b[i] - a[i]
+		}
+		lo, hi := stats.Bootstrap(diffs, *level, *numResamples, rand.New(rand.NewSource(*bootstrapSeed)))
+		fmt.Printf("BOOTSTRAP: %g%% CI [%f, %f] (%d resamples)\n", pct, lo, hi, *numResamples)
+	}
+	alpha := 1 - *level
+	switch {
+	case test.P >= alpha:
+		fmt.Printf("no significant difference at the %g%% level\n", pct)
+	case test.MeanDiff > 0:
+		fmt.Printf("B clears significantly more than A at the %g%% level\n", pct)
+	default:
+		fmt.Printf("B clears significantly less than A at the %g%% level\n", pct)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/Div9851/new-warehouse-sim/config"
+	"github.com/Div9851/new-warehouse-sim/mapdata"
+	"github.com/Div9851/new-warehouse-sim/sim"
+)
+
+// traceRun は seed で 1 回シミュレーションし、各ターンの軌跡と最後の集計を文字列で返す
+func traceRun(mapData *mapdata.MapData, config *config.Config, seed int64) (string, error) {
+	var trace bytes.Buffer
+	s, err := sim.New(mapData, config, false, seed)
+	if err != nil {
+		return "", err
+	}
+	s.Trace = &trace
+	itemsCount, pickUpCount, clearCount := s.Run()
+	fmt.Fprintf(&trace, "items %v pickup %v clear %v iters %v\n", itemsCount, pickUpCount, clearCount, s.IterCount)
+	m := s.Metrics
+	fmt.Fprintf(&trace, "latency %v %v collisions %v stay %v idle %v distance %v exchanged %d saved %d\n",
+		m.SpawnToPickup, m.PickupToClear, m.Collisions, m.StayTurns, m.IdleTurns, m.Distance, m.ExchangedItems, m.ExchangeDistSaved)
+	return trace.String(), nil
+}
+
+// traceRuns は GOMAXPROCS を procs にして numRuns 回の実行の軌跡を求める
+// parallel が true の場合は全ての実行を並行に、そうでなければ 1 回ずつ順に行う
+func traceRuns(mapData *mapdata.MapData, config *config.Config, numRuns int, procs int, parallel bool) ([]string, error) {
+	prev := runtime.GOMAXPROCS(procs)
+	defer runtime.GOMAXPROCS(prev)
+	traces := make([]string, numRuns)
+	errs := make([]error, numRuns)
+	var wg sync.WaitGroup
+	for run := 0; run < numRuns; run++ {
+		wg.Add(1)
+		go func(run int) {
+			traces[run], errs[run] = traceRun(mapData, config, config.RandSeed+int64(run))
+			wg.Done()
+		}(run)
+		if !parallel {
+			wg.Wait()
+		}
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return traces, nil
+}
+
+// diffTrace は 2 つの軌跡が最初に食い違う行の番号 (1 始まり) と各々の行を返す
+// 一致する場合は 0 を返す
+func diffTrace(a string, b string) (int, string, string) {
+	linesA := strings.Split(a, "\n")
+	linesB := strings.Split(b, "\n")
+	for i := 0; i < len(linesA) || i < len(linesB); i++ {
+		var lineA, lineB string
+		if i < len(linesA) {
+			lineA = linesA[i]
+		}
+		if i < len(linesB) {
+			lineB = linesB[i]
+		}
+		if lineA != lineB {
+			return i + 1, lineA, lineB
+		}
+	}
+	return 0, "", ""
+}
+
+// checkDeterminism は各シードを GOMAXPROCS=1 で 1 回ずつ順に実行した結果と、
+// GOMAXPROCS を増やして全てのシードを並行に実行した結果が完全に一致するかどうかを確かめる
+func checkDeterminism(mapData *mapdata.MapData, config *config.Config, numRuns int) error {
+	if config.PlanningTimeMs > 0 {
+		return fmt.Errorf("can't check determinism with planningTimeMs (the number of iterations depends on timing)")
+	}
+	if config.TreeParallel && config.Workers() > 1 {
+		return fmt.Errorf("can't check determinism with treeParallel (the search depends on the order of goroutines)")
+	}
+	sequential, err := traceRuns(mapData, config, numRuns, 1, false)
+	if err != nil {
+		return err
+	}
+	procs := runtime.NumCPU()
+	if procs < 4 {
+		procs = 4
+	}
+	parallel, err := traceRuns(mapData, config, numRuns, procs, true)
+	if err != nil {
+		return err
+	}
+	for run := range sequential {
+		if line, a, b := diffTrace(sequential[run], parallel[run]); line > 0 {
+			return fmt.Errorf("run %d diverged at line %d\n  GOMAXPROCS=1:  %s\n  GOMAXPROCS=%d: %s", run, line, a, procs, b)
+		}
+	}
+	return nil
+}
+
+// checkGolden は最初のシードの軌跡を goldenFile に記録された軌跡と比べる
+// update が true の場合は比べる代わりに goldenFile を書き換える
+func checkGolden(mapData *mapdata.MapData, config *config.Config, goldenFile string, update bool) error {
+	trace, err := traceRun(mapData, config, config.RandSeed)
+	if err != nil {
+		return err
+	}
+	if update {
+		if err := ioutil.WriteFile(goldenFile, []byte(trace), 0644); err != nil {
+			return fmt.Errorf("can't write `%s` (%s)", goldenFile, err)
+		}
+		return nil
+	}
+	golden, err := ioutil.ReadFile(goldenFile)
+	if err != nil {
+		return fmt.Errorf("can't read `%s` (%s)", goldenFile, err)
+	}
+	if line, want, got := diffTrace(string(golden), trace); line > 0 {
+		return fmt.Errorf("trajectory differs from `%s` at line %d\n  golden: %s\n  got:    %s", goldenFile, line, want, got)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/Div9851/new-warehouse-sim/layout"
+	"github.com/Div9851/new-warehouse-sim/mapdata"
+)
+
+// runGen は倉庫のレイアウトを生成して mapdata の形式で書き出す
+func runGen(args []string) {
+	var (
+		flags      = flag.NewFlagSet("gen", flag.ExitOnError)
+		outputFile = flags.String("o", "", "path of output mapdata file (default stdout)")
+		params     layout.Params
+	)
+	flags.IntVar(&params.BlockRows, "block-rows", 2, "number of shelf blocks in a column")
+	flags.IntVar(&params.BlockCols, "block-cols", 4, "number of shelf blocks in a row")
+	flags.IntVar(&params.BlockWidth, "block-width", 2, "width of a shelf block")
+	flags.IntVar(&params.BlockHeight, "block-height", 3, "height of a shelf block")
+	flags.IntVar(&params.AisleWidth, "aisle-width", 1, "width of aisles")
+	flags.IntVar(&params.CrossAisleSpacing, "cross-aisle-spacing", 1, "number of block rows between cross aisles (0 for none)")
+	flags.IntVar(&params.NumDepots, "depots", 1, "number of depots")
+	flags.StringVar(&params.DepotPlacement, "depot-placement", layout.DepotLeft, "placement of depots (TOP, BOTTOM, LEFT, RIGHT or RANDOM)")
+	flags.Int64Var(&params.Seed, "seed", 0, "random seed")
+
+	flags.Parse(args)
+
+	text, err := layout.Generate(&params)
+	if err != nil {
+		fatal(err)
+	}
+	// 生成したマップがシミュレータで扱えることを確かめる
+	if _, err := mapdata.Parse(text); err != nil {
+		fatal(fmt.Errorf("generated map is invalid (%s)", err))
+	}
+	out := strings.Join(text, "\n") + "\n"
+	if *outputFile == "" {
+		fmt.Print(out)
+		return
+	}
+	if err := ioutil.WriteFile(*outputFile, []byte(out), 0644); err != nil {
+		fatal(fmt.Errorf("can't write `%s` (%s)", *outputFile, err))
+	}
+	fmt.Fprintf(os.Stderr, "wrote `%s` (%dx%d)\n", *outputFile, len(text), len(text[0]))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/Div9851/new-warehouse-sim/config"
+	"github.com/Div9851/new-warehouse-sim/mapdata"
+)
+
+// 意図して挙動を変えた場合は go test ./cmd -run TestGolden -update で記録済みの軌跡を更新する
+var update = flag.Bool("update", false, "update the golden trajectory")
+
+const (
+	goldenMapDataFile = "../testdata/mapdata/warehouse-medium"
+	goldenConfigFile  = "../testdata/config/golden.json"
+	goldenTraceFile   = "../testdata/golden/warehouse-medium.trace"
+)
+
+// loadGolden は記録済みの軌跡を作ったマップと設定を読み込む
+// 環境変数による上書きは使わない
+func loadGolden(t *testing.T) (*mapdata.MapData, *config.Config) {
+	t.Helper()
+	inputs := inputOptions{mapDataFile: goldenMapDataFile, mapOpts: mapOptions{format: "auto"}}
+	mapData, err := loadMapData(inputs.mapDataFile, &inputs.mapOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(goldenConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	config, err := config.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := inputs.prepare(mapData, config); err != nil {
+		t.Fatal(err)
+	}
+	return mapData, config
+}
+
+// 最初のシードの軌跡をターンごとに記録済みの軌跡と比べる
+func TestGolden(t *testing.T) {
+	mapData, config := loadGolden(t)
+	if err := checkGolden(mapData, config, goldenTraceFile, *update); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ワーカー数ごとに、GOMAXPROCS=1 で順に実行した軌跡と GOMAXPROCS を増やして並行に実行した軌跡が一致することを確かめる
+func TestDeterminism(t *testing.T) {
+	mapData, base := loadGolden(t)
+	workerCounts := []int{1, 2, 4}
+	if testing.Short() {
+		workerCounts = []int{base.NumWorkers}
+	}
+	for _, numWorkers := range workerCounts {
+		config := *base
+		config.NumWorkers = numWorkers
+		if err := checkDeterminism(mapData, &config, 2); err != nil {
+			t.Errorf("numWorkers %d: %s", numWorkers, err)
+		}
+	}
+}
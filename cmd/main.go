@@ -7,30 +7,58 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"sync"
+	"path/filepath"
+	"runtime"
+	"strings"
 
 	"github.com/Div9851/new-warehouse-sim/config"
 	"github.com/Div9851/new-warehouse-sim/mapdata"
 	"github.com/Div9851/new-warehouse-sim/sim"
+	"github.com/Div9851/new-warehouse-sim/trajectory"
 )
 
-func calcAvgVar(s []float64) (float64, float64) {
-	n := len(s)
-	var (
-		average  float64
-		variance float64
-	)
-	for _, x := range s {
-		average += x
-		variance += x * x
+// posList は "r,c" 形式で繰り返し指定できるフラグ
+type posList []mapdata.Pos
+
+func (list *posList) String() string {
+	return fmt.Sprint(*list)
+}
+
+func (list *posList) Set(value string) error {
+	var pos mapdata.Pos
+	if _, err := fmt.Sscanf(value, "%d,%d", &pos.R, &pos.C); err != nil {
+		return fmt.Errorf("expected `row,column` but got `%s`", value)
 	}
-	average /= float64(n)
-	variance /= float64(n)
-	variance -= average * average
-	return average, variance
+	*list = append(*list, pos)
+	return nil
 }
 
-func loadMapData(path string) (*mapdata.MapData, error) {
+type mapOptions struct {
+	format           string
+	sidecarFile      string
+	depots           posList
+	shelves          posList
+	pruneUnreachable bool
+}
+
+func loadMapData(path string, opts *mapOptions) (*mapdata.MapData, error) {
+	format := opts.format
+	if format == "auto" {
+		format = "text"
+		if filepath.Ext(path) == ".map" {
+			format = "movingai"
+		}
+	}
+	switch format {
+	case "text":
+		return loadTextMapData(path)
+	case "movingai":
+		return loadMovingAIMapData(path, opts)
+	}
+	return nil, fmt.Errorf("unknown map format `%s`", opts.format)
+}
+
+func loadTextMapData(path string) (*mapdata.MapData, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("can't open `%s` (%s)", path, err)
@@ -45,108 +73,292 @@ func loadMapData(path string) (*mapdata.MapData, error) {
 	if scanner.Err() != nil {
 		return nil, fmt.Errorf("can't read `%s` (%s)", path, scanner.Err())
 	}
-	return mapdata.New(lines), nil
+	mapData, err := mapdata.Parse(lines)
+	if err != nil {
+		return nil, fmt.Errorf("invalid map `%s` (%s)", path, err)
+	}
+	return mapData, nil
 }
 
-func loadConfig(path string) (*config.Config, error) {
+func loadMovingAIMapData(path string, opts *mapOptions) (*mapdata.MapData, error) {
+	var overlay mapdata.Overlay
+	if opts.sidecarFile != "" {
+		b, err := ioutil.ReadFile(opts.sidecarFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read `%s` (%s)", opts.sidecarFile, err)
+		}
+		if err := json.Unmarshal(b, &overlay); err != nil {
+			return nil, fmt.Errorf("can't decode `%s` (%s)", opts.sidecarFile, err)
+		}
+	}
+	overlay.Depots = append(overlay.Depots, opts.depots...)
+	overlay.Shelves = append(overlay.Shelves, opts.shelves...)
+
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, fmt.Errorf("can't open `%s` (%s)", path, err)
 	}
 	defer f.Close()
 
-	b, err := ioutil.ReadAll(f)
+	mapData, err := mapdata.ParseMovingAI(f, &overlay, opts.pruneUnreachable)
 	if err != nil {
-		return nil, fmt.Errorf("can't read `%s` (%s)", path, err)
+		return nil, fmt.Errorf("invalid map `%s` (%s)", path, err)
 	}
+	return mapData, nil
+}
+
+// inputOptions はシミュレーションの入力となるマップと設定を指定するフラグ
+type inputOptions struct {
+	mapDataFile string
+	configFile  string
+	mapOpts     mapOptions
+	sets        overrideList // 設定の項目の上書き (環境変数の後に適用する)
+}
 
-	var config config.Config
-	err = json.Unmarshal(b, &config)
+func (inputs *inputOptions) addFlags(flags *flag.FlagSet) {
+	inputs.addMapFlags(flags)
+	flags.StringVar(&inputs.configFile, "config-file", "", "path of config file")
+	inputs.addSetFlag(flags)
+}
+
+func (inputs *inputOptions) addSetFlag(flags *flag.FlagSet) {
+	flags.Var(&inputs.sets, "set", "override a config field as `key=value` after "+envPrefix+"* environment variables (repeatable)")
+}
+
+func (inputs *inputOptions) addMapFlags(flags *flag.FlagSet) {
+	flags.StringVar(&inputs.mapDataFile, "mapdata-file", "", "path of mapdata file")
+	flags.StringVar(&inputs.mapOpts.format, "map-format", "auto", "format of mapdata file (text, movingai or auto)")
+	flags.StringVar(&inputs.mapOpts.sidecarFile, "map-sidecar", "", "path of JSON file with depots and shelves for a movingai map")
+	flags.Var(&inputs.mapOpts.depots, "depot", "depot position `row,column` for a movingai map (repeatable)")
+	flags.Var(&inputs.mapOpts.shelves, "shelf", "shelf position `row,column` for a movingai map (repeatable)")
+	flags.BoolVar(&inputs.mapOpts.pruneUnreachable, "prune-unreachable", true, "turn cells unreachable from the depots into walls for a movingai map")
+}
+
+// load はマップと設定を読み込み、prepare する
+func (inputs *inputOptions) load() (*mapdata.MapData, *config.Config, error) {
+	mapData, err := loadMapData(inputs.mapDataFile, &inputs.mapOpts)
+	if err != nil {
+		return nil, nil, err
+	}
+	config, err := inputs.loadConfig(inputs.configFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := inputs.prepare(mapData, config); err != nil {
+		return nil, nil, err
+	}
+	return mapData, config, nil
+}
+
+// check は mapData と config の組み合わせを確かめる
+func (inputs *inputOptions) check(mapData *mapdata.MapData, config *config.Config) error {
+	if err := sim.Check(mapData, config); err != nil {
+		return fmt.Errorf("can't run on `%s` (%s)", inputs.mapDataFile, err)
+	}
+	return nil
+}
+
+// prepare は mapData と config の組み合わせを確かめたうえで、config の距離のオラクルを mapData に用意する
+func (inputs *inputOptions) prepare(mapData *mapdata.MapData, config *config.Config) error {
+	if err := inputs.check(mapData, config); err != nil {
+		return err
+	}
+	oracle, err := mapdata.NewOracle(config.Oracle(), mapData)
 	if err != nil {
-		return nil, fmt.Errorf("can't decode `%s` (%s)", path, err)
+		return err
 	}
-	return &config, nil
+	mapData.Oracle = oracle
+	return nil
+}
+
+// oracleCache は設定ごとにマップの写しを用意する
+// DENSE のように作るのに時間のかかるものがあるので、距離のオラクルは種類ごとに 1 度だけ作って共有する
+type oracleCache struct {
+	mapData *mapdata.MapData
+	oracles map[string]mapdata.DistanceOracle
+}
+
+func newOracleCache(mapData *mapdata.MapData) *oracleCache {
+	return &oracleCache{mapData: mapData, oracles: make(map[string]mapdata.DistanceOracle)}
+}
+
+// mapFor は config の距離のオラクルを持つマップの写しを返す (config は check 済みのものとする)
+func (cache *oracleCache) mapFor(config *config.Config) (*mapdata.MapData, error) {
+	kind := config.Oracle()
+	oracle, ok := cache.oracles[kind]
+	if !ok {
+		var err error
+		if oracle, err = mapdata.NewOracle(kind, cache.mapData); err != nil {
+			return nil, err
+		}
+		cache.oracles[kind] = oracle
+	}
+	mapData := *cache.mapData
+	mapData.Oracle = oracle
+	return &mapData, nil
+}
+
+// recordPath は run 番目の実行の軌跡を書き出すファイルのパスを返す
+// 複数回実行する場合は path の拡張子の前に実行の番号を加える (traj.jsonl -> traj-3.jsonl)
+func recordPath(path string, run int, numRuns int) string {
+	if numRuns == 1 {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(path, ext), run, ext)
+}
+
+// runner は run 番目の実行を行う関数を返す
+// recordFile が空でない場合は recordPath で決まるファイルに軌跡を書き出す
+func runner(mapData *mapdata.MapData, config *config.Config, numRuns int, verbose bool, recordFile string) func(run int) (runOutcome, error) {
+	return func(run int) (runOutcome, error) {
+		seed := config.RandSeed + int64(run)
+		sim, err := sim.New(mapData, config, verbose, seed)
+		if err != nil {
+			return runOutcome{}, err
+		}
+		var record *os.File
+		if recordFile != "" {
+			path := recordPath(recordFile, run, numRuns)
+			if record, err = os.Create(path); err != nil {
+				return runOutcome{}, fmt.Errorf("can't create `%s` (%s)", path, err)
+			}
+			defer record.Close()
+			sim.Recorder = trajectory.NewRecorder(record, &trajectory.Header{Map: mapData.Text, Config: effectiveConfig(config), Seed: seed})
+		}
+		itemsCount, pickUpCount, clearCount := sim.Run()
+		if record != nil {
+			if err := sim.Recorder.Close(); err != nil {
+				return runOutcome{}, fmt.Errorf("can't write `%s` (%s)", record.Name(), err)
+			}
+		}
+		return runOutcome{
+			Run:         run,
+			Seed:        seed,
+			ItemsCount:  itemsCount,
+			PickUpCount: pickUpCount,
+			ClearCount:  clearCount,
+			IterCount:   sim.IterCount,
+			Metrics:     sim.Metrics,
+		}, nil
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "error: %s\n", err)
+	os.Exit(1)
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "gen":
+			runGen(os.Args[2:])
+			return
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		case "serve":
+			runServe(os.Args[2:])
+			return
+		case "sweep":
+			runSweep(os.Args[2:])
+			return
+		case "compare":
+			runCompare(os.Args[2:])
+			return
+		}
+	}
+	runSim(os.Args[1:])
+}
+
+func runSim(args []string) {
 	var (
-		Run         = flag.Int("run", 1, "number of runs")
-		mapDataFile = flag.String("mapdata-file", "", "path of mapdata file")
-		configFile  = flag.String("config-file", "", "path of config file")
-		verbose     = flag.Bool("verbose", false, "verbosity")
+		flags      = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+		Run        = flags.Int("run", 1, "number of runs")
+		verbose    = flags.Bool("verbose", false, "verbosity")
+		tui        = flags.Bool("tui", false, "run the first seed interactively in the terminal")
+		checkDet   = flags.Bool("check-determinism", false, "run each seed twice with different GOMAXPROCS and parallelism and compare the trajectories")
+		goldenFile = flags.String("golden", "", "compare the trajectory of the first seed with this file")
+		update     = flags.Bool("update-golden", false, "rewrite the file given by -golden instead of comparing")
+		recordFile = flags.String("record", "", "path of trajectory log file (with multiple runs, the run number is added before the extension)")
+		parallel   = flags.Int("parallel", runtime.NumCPU(), "maximum number of runs executed at the same time")
+		format     = flags.String("output-format", outputText, "format of results (text, json or csv)")
+		outputFile = flags.String("output-file", "", "path of results file for json or csv (default: stdout); csv also writes the config next to it as <name>.config.json")
+		inputs     inputOptions
 	)
+	inputs.addFlags(flags)
 
-	flag.Parse()
+	flags.Parse(args)
 
-	mapData, err := loadMapData(*mapDataFile)
-	if err != nil {
-		panic(err)
+	switch *format {
+	case outputText:
+		if *outputFile != "" {
+			fatal(fmt.Errorf("-output-file requires -output-format json or csv"))
+		}
+	case outputJSON, outputCSV:
+	default:
+		fatal(fmt.Errorf("unknown output format `%s`", *format))
+	}
+
+	if *parallel < 1 {
+		fatal(fmt.Errorf("-parallel must be positive"))
 	}
-	config, err := loadConfig(*configFile)
+
+	mapData, config, err := inputs.load()
 	if err != nil {
-		panic(err)
-	}
-	itemsCountHistory := make([][]float64, config.NumAgents)
-	clearCountHistory := make([][]float64, config.NumAgents)
-	clearRateHistory := make([][]float64, config.NumAgents)
-	for i := 0; i < config.NumAgents; i++ {
-		itemsCountHistory[i] = make([]float64, *Run)
-		clearCountHistory[i] = make([]float64, *Run)
-		clearRateHistory[i] = make([]float64, *Run)
-	}
-	var wg sync.WaitGroup
-	for run := 0; run < *Run; run++ {
-		wg.Add(1)
-		go func(run int) {
-			fmt.Printf("--- run %d start ---\n", run)
-			sim := sim.New(mapData, config, *verbose, config.RandSeed+int64(run))
-			itemsCount, _, clearCount := sim.Run()
-			for i := 0; i < config.NumAgents; i++ {
-				r := float64(clearCount[i]) / float64(itemsCount[i])
-				itemsCountHistory[i][run] = float64(itemsCount[i])
-				clearCountHistory[i][run] = float64(clearCount[i])
-				clearRateHistory[i][run] = r
+		fatal(err)
+	}
+	// 結果を標準出力に JSON や CSV で書く場合は、設定や進み具合を標準エラー出力に出す
+	progress := os.Stdout
+	if *format != outputText {
+		progress = os.Stderr
+	}
+	if *tui {
+		s, err := sim.New(mapData, config, false, config.RandSeed)
+		if err != nil {
+			fatal(err)
+		}
+		if err := runTUI(s); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	printConfig(progress, "config", config)
+	if *checkDet || *goldenFile != "" {
+		if *checkDet {
+			if err := checkDeterminism(mapData, config, *Run); err != nil {
+				fatal(err)
+			}
+			fmt.Printf("determinism check passed (%d runs)\n", *Run)
+		}
+		if *goldenFile != "" {
+			if err := checkGolden(mapData, config, *goldenFile, *update); err != nil {
+				fatal(err)
+			}
+			if *update {
+				fmt.Printf("updated golden trajectory `%s`\n", *goldenFile)
+			} else {
+				fmt.Printf("golden trajectory `%s` matches\n", *goldenFile)
 			}
-			fmt.Printf("--- run %d end ---\n", run)
-			wg.Done()
-		}(run)
-	}
-	wg.Wait()
-	totalItemsCountHistory := make([]float64, *Run)
-	totalClearCountHistory := make([]float64, *Run)
-	totalClearRateHistory := make([]float64, *Run)
-	for i := 0; i < *Run; i++ {
-		for j := 0; j < config.NumAgents; j++ {
-			totalItemsCountHistory[i] += itemsCountHistory[j][i]
-			totalClearCountHistory[i] += clearCountHistory[j][i]
 		}
-		totalClearRateHistory[i] = totalClearCountHistory[i] / totalItemsCountHistory[i]
-	}
-	fmt.Println("--items count--")
-	for i := 0; i < config.NumAgents; i++ {
-		average, variance := calcAvgVar(itemsCountHistory[i])
-		fmt.Printf("AGENT %d: avg. %f var. %f\n", i, average, variance)
-	}
-	{
-		average, variance := calcAvgVar(totalItemsCountHistory)
-		fmt.Printf("TOTAL: avg. %f var. %f\n", average, variance)
-	}
-	fmt.Println("--clear count--")
-	for i := 0; i < config.NumAgents; i++ {
-		average, variance := calcAvgVar(clearCountHistory[i])
-		fmt.Printf("AGENT %d: avg. %f var. %f\n", i, average, variance)
-	}
-	{
-		average, variance := calcAvgVar(totalClearCountHistory)
-		fmt.Printf("TOTAL: avg. %f var. %f\n", average, variance)
-	}
-	fmt.Println("--clear rate--")
-	for i := 0; i < config.NumAgents; i++ {
-		average, variance := calcAvgVar(clearRateHistory[i])
-		fmt.Printf("AGENT %d: avg. %f var. %f\n", i, average, variance)
-	}
-	{
-		average, variance := calcAvgVar(totalClearRateHistory)
-		fmt.Printf("TOTAL: avg. %f var. %f\n", average, variance)
+		return
+	}
+	outcomes, failed, interrupted := runPool(*Run, *parallel, progress, runner(mapData, config, *Run, *verbose, *recordFile))
+	if len(outcomes) == 0 {
+		fatal(fmt.Errorf("no runs completed"))
+	}
+	if *format != outputText {
+		if err := writeResults(*format, *outputFile, inputs.mapDataFile, mapData, config, outcomes); err != nil {
+			fatal(err)
+		}
+	} else {
+		printResults(outcomes, config)
+	}
+	if interrupted {
+		os.Exit(130)
+	}
+	if failed > 0 {
+		os.Exit(1)
 	}
 }
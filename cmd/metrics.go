@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Div9851/new-warehouse-sim/config"
+	"github.com/Div9851/new-warehouse-sim/sim"
+	"github.com/Div9851/new-warehouse-sim/stats"
+)
+
+// formatStats は s の平均と分散を、値が 2 つ以上ある場合は標準誤差と t 分布に基づく 95% 信頼区間も加えて表示用に整える
+func formatStats(s []float64) string {
+	w := stats.Of(s)
+	str := fmt.Sprintf("avg. %f var. %f", w.Mean(), w.Var())
+	if w.N() >= 2 {
+		lo, hi := w.TInterval(0.95)
+		str += fmt.Sprintf(" se. %f 95%% CI [%f, %f]", w.StdErr(), lo, hi)
+	}
+	return str
+}
+
+// printResults は outcomes の各指標を実行にわたって集計して表示する
+func printResults(outcomes []runOutcome, config *config.Config) {
+	numRuns := len(outcomes)
+	itemsCountHistory := make([][]float64, config.NumAgents)
+	clearCountHistory := make([][]float64, config.NumAgents)
+	clearRateHistory := make([][]float64, config.NumAgents)
+	itersHistory := make([][]float64, config.NumAgents)
+	metricsHistory := make([]*sim.Metrics, numRuns)
+	for i := 0; i < config.NumAgents; i++ {
+		itemsCountHistory[i] = make([]float64, numRuns)
+		clearCountHistory[i] = make([]float64, numRuns)
+		clearRateHistory[i] = make([]float64, numRuns)
+		itersHistory[i] = make([]float64, numRuns)
+	}
+	for run, outcome := range outcomes {
+		for i := 0; i < config.NumAgents; i++ {
+			itemsCountHistory[i][run] = float64(outcome.ItemsCount[i])
+			clearCountHistory[i][run] = float64(outcome.ClearCount[i])
+			clearRateHistory[i][run] = float64(outcome.ClearCount[i]) / float64(outcome.ItemsCount[i])
+			itersHistory[i][run] = float64(outcome.IterCount[i]) / float64(config.LastTurn)
+		}
+		metricsHistory[run] = outcome.Metrics
+	}
+	totalItemsCountHistory := make([]float64, numRuns)
+	totalClearCountHistory := make([]float64, numRuns)
+	totalClearRateHistory := make([]float64, numRuns)
+	for i := 0; i < numRuns; i++ {
+		for j := 0; j < config.NumAgents; j++ {
+			totalItemsCountHistory[i] += itemsCountHistory[j][i]
+			totalClearCountHistory[i] += clearCountHistory[j][i]
+		}
+		totalClearRateHistory[i] = totalClearCountHistory[i] / totalItemsCountHistory[i]
+	}
+	fmt.Println("--items count--")
+	for i := 0; i < config.NumAgents; i++ {
+		fmt.Printf("AGENT %d: %s\n", i, formatStats(itemsCountHistory[i]))
+	}
+	fmt.Printf("TOTAL: %s\n", formatStats(totalItemsCountHistory))
+	fmt.Println("--clear count--")
+	for i := 0; i < config.NumAgents; i++ {
+		fmt.Printf("AGENT %d: %s\n", i, formatStats(clearCountHistory[i]))
+	}
+	fmt.Printf("TOTAL: %s\n", formatStats(totalClearCountHistory))
+	fmt.Println("--clear rate--")
+	for i := 0; i < config.NumAgents; i++ {
+		fmt.Printf("AGENT %d: %s\n", i, formatStats(clearRateHistory[i]))
+	}
+	fmt.Printf("TOTAL: %s\n", formatStats(totalClearRateHistory))
+	if config.PlanningTimeMs > 0 {
+		fmt.Println("--planning iterations per turn--")
+		for i := 0; i < config.NumAgents; i++ {
+			fmt.Printf("AGENT %d: %s\n", i, formatStats(itersHistory[i]))
+		}
+	}
+	printMetrics(metricsHistory, config.NumAgents)
+}
+
+// printMetrics は各実行の Metrics を集計して表示する
+// エージェントごとの指標は実行ごとの値の平均と分散を、
+// アイテムごとの遅延は全ての実行のアイテムを合わせた平均と分散を表示する
+func printMetrics(history []*sim.Metrics, numAgents int) {
+	perAgent := func(title string, value func(metrics *sim.Metrics) []int) {
+		fmt.Printf("--%s--\n", title)
+		total := make([]float64, len(history))
+		for i := 0; i < numAgents; i++ {
+			s := make([]float64, len(history))
+			for run, metrics := range history {
+				s[run] = float64(value(metrics)[i])
+				total[run] += s[run]
+			}
+			fmt.Printf("AGENT %d: %s\n", i, formatStats(s))
+		}
+		fmt.Printf("TOTAL: %s\n", formatStats(total))
+	}
+	perItem := func(title string, value func(metrics *sim.Metrics) []int) {
+		fmt.Printf("--%s--\n", title)
+		var s []float64
+		for _, metrics := range history {
+			for _, x := range value(metrics) {
+				s = append(s, float64(x))
+			}
+		}
+		if len(s) == 0 {
+			fmt.Println("ITEMS: none")
+			return
+		}
+		fmt.Printf("ITEMS: %s (n=%d)\n", formatStats(s), len(s))
+	}
+	perRun := func(label string, value func(metrics *sim.Metrics) int) {
+		s := make([]float64, len(history))
+		for run, metrics := range history {
+			s[run] = float64(value(metrics))
+		}
+		fmt.Printf("%s: %s\n", label, formatStats(s))
+	}
+
+	perItem("spawn to pickup latency", func(metrics *sim.Metrics) []int { return metrics.SpawnToPickup })
+	perItem("pickup to clear latency", func(metrics *sim.Metrics) []int { return metrics.PickupToClear })
+	perAgent("collisions", func(metrics *sim.Metrics) []int { return metrics.Collisions })
+	perAgent("stay turns", func(metrics *sim.Metrics) []int { return metrics.StayTurns })
+	perAgent("idle turns", func(metrics *sim.Metrics) []int { return metrics.IdleTurns })
+	perAgent("distance", func(metrics *sim.Metrics) []int { return metrics.Distance })
+	fmt.Println("--exchange--")
+	perRun("EXCHANGED ITEMS", func(metrics *sim.Metrics) int { return metrics.ExchangedItems })
+	perRun("DISTANCE SAVED", func(metrics *sim.Metrics) int { return metrics.ExchangeDistSaved })
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"unicode"
+
+	"github.com/Div9851/new-warehouse-sim/config"
+)
+
+// 設定の項目を上書きする環境変数の接頭辞 (numAgents は WAREHOUSE_SIM_NUM_AGENTS になる)
+const envPrefix = "WAREHOUSE_SIM_"
+
+// override は設定の項目 (JSON のキー) を value (JSON) で上書きすること
+type override struct {
+	Key   string
+	Value json.RawMessage
+}
+
+// overrideList は "key=value" の形式で繰り返し指定できるフラグ
+type overrideList []override
+
+func (list *overrideList) String() string {
+	var s []string
+	for _, o := range *list {
+		s = append(s, fmt.Sprintf("%s=%s", o.Key, o.Value))
+	}
+	return strings.Join(s, " ")
+}
+
+func (list *overrideList) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected `key=value` but got `%s`", value)
+	}
+	key := value[:i]
+	if _, ok := configKeys()[key]; !ok {
+		return fmt.Errorf("unknown config key `%s`", key)
+	}
+	*list = append(*list, override{Key: key, Value: parseValue(value[i+1:])})
+	return nil
+}
+
+// configKeys は config.Config の項目の JSON のキーを返す
+func configKeys() map[string]struct{} {
+	keys := make(map[string]struct{})
+	t := reflect.TypeOf(config.Config{})
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if key != "" && key != "-" {
+			keys[key] = struct{}{}
+		}
+	}
+	return keys
+}
+
+// parseValue は s を JSON の値として解釈し、解釈できない場合は文字列とする
+// (requestStrategy=RANDOM のように文字列を引用符なしで書ける)
+func parseValue(s string) json.RawMessage {
+	if json.Valid([]byte(s)) {
+		return json.RawMessage(s)
+	}
+	b, _ := json.Marshal(s)
+	return json.RawMessage(b)
+}
+
+// envName は key を上書きする環境変数の名前を返す
+func envName(key string) string {
+	var name strings.Builder
+	name.WriteString(envPrefix)
+	for i, r := range key {
+		if unicode.IsUpper(r) && i > 0 {
+			name.WriteByte('_')
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+	return name.String()
+}
+
+// envOverrides は envPrefix で始まる環境変数による上書きを返す
+// 設定の項目に対応しない環境変数がある場合はエラーにする
+func envOverrides() ([]override, error) {
+	keys := make(map[string]string)
+	for key := range configKeys() {
+		keys[envName(key)] = key
+	}
+	var overrides []override
+	for _, env := range os.Environ() {
+		i := strings.Index(env, "=")
+		name, value := env[:i], env[i+1:]
+		if !strings.HasPrefix(name, envPrefix) {
+			continue
+		}
+		key, ok := keys[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown config key in environment variable `%s`", name)
+		}
+		overrides = append(overrides, override{Key: key, Value: parseValue(value)})
+	}
+	return overrides, nil
+}
+
+// applyOverrides は JSON の設定 base の項目を overrides の順に上書きした JSON を返す
+func applyOverrides(base []byte, overrides []override) ([]byte, error) {
+	if len(overrides) == 0 {
+		return base, nil
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(base, &fields); err != nil {
+		return nil, err
+	}
+	for _, o := range overrides {
+		fields[o.Key] = o.Value
+	}
+	return json.Marshal(fields)
+}
+
+// readConfig は path の設定を読み、環境変数、-set の順に上書きした JSON を返す
+func (inputs *inputOptions) readConfig(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read `%s` (%s)", path, err)
+	}
+	overrides, err := envOverrides()
+	if err != nil {
+		return nil, err
+	}
+	b, err = applyOverrides(b, append(overrides, inputs.sets...))
+	if err != nil {
+		return nil, fmt.Errorf("can't decode `%s` (%s)", path, err)
+	}
+	return b, nil
+}
+
+// loadConfig は path の設定を読み、上書きしたうえで検証する
+func (inputs *inputOptions) loadConfig(path string) (*config.Config, error) {
+	b, err := inputs.readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	config, err := config.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("invalid config `%s` (%s)", path, err)
+	}
+	return config, nil
+}
+
+// effectiveConfig は結果や軌跡に記録するための、省略した項目を既定値で埋めた設定を返す
+func effectiveConfig(config *config.Config) *config.Config {
+	effective := config.Effective()
+	return &effective
+}
+
+// printConfig は実際に使う設定を 1 行の JSON で表示する
+// 省略した項目も既定値で埋め、omitempty によらず全ての項目を書く
+func printConfig(w io.Writer, label string, config *config.Config) {
+	effective := config.Effective()
+	v := reflect.ValueOf(effective)
+	var fields []string
+	for i := 0; i < v.NumField(); i++ {
+		key := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		b, _ := json.Marshal(v.Field(i).Interface())
+		fields = append(fields, fmt.Sprintf("%q:%s", key, b))
+	}
+	fmt.Fprintf(w, "%s: {%s}\n", label, strings.Join(fields, ","))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"time"
+)
+
+// runPool は runOne で numRuns 回の実行を同時に parallel 個まで行い、成功した実行の結果を番号の順に返す
+// 実行が終わるごとに進み具合と残り時間の見積もりを progress に書く
+// SIGINT を受け取った場合は実行中のものを待たずに打ち切り、interrupted を true にしてそれまでの結果を返す
+func runPool(numRuns int, parallel int, progress io.Writer, runOne func(run int) (runOutcome, error)) (outcomes []runOutcome, failed int, interrupted bool) {
+	type result struct {
+		run     int
+		outcome runOutcome
+		err     error
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	defer signal.Stop(sigs)
+
+	// 打ち切った実行が送る結果で goroutine が止まらないように、同時に実行する数だけ余裕を持たせる
+	results := make(chan result, parallel)
+	next, running := 0, 0
+	start := func() {
+		run := next
+		next++
+		running++
+		fmt.Fprintf(progress, "--- run %d start ---\n", run)
+		go func() {
+			outcome, err := runOne(run)
+			results <- result{run: run, outcome: outcome, err: err}
+		}()
+	}
+	startTime := time.Now()
+	for next < numRuns && running < parallel {
+		start()
+	}
+	for running > 0 && !interrupted {
+		select {
+		case <-sigs:
+			fmt.Fprintf(progress, "--- interrupted: abandoned %d running and %d pending runs ---\n", running, numRuns-next)
+			interrupted = true
+		case r := <-results:
+			running--
+			if r.err != nil {
+				failed++
+				fmt.Fprintf(os.Stderr, "error: run %d: %s\n", r.run, r.err)
+			} else {
+				outcomes = append(outcomes, r.outcome)
+			}
+			done := len(outcomes) + failed
+			elapsed := time.Since(startTime)
+			eta := elapsed / time.Duration(done) * time.Duration(numRuns-done)
+			fmt.Fprintf(progress, "--- run %d end --- %d/%d completed, %d failed, elapsed %v, ETA %v\n",
+				r.run, len(outcomes), numRuns, failed, elapsed.Round(time.Second/10), eta.Round(time.Second))
+			if next < numRuns {
+				start()
+			}
+		}
+	}
+	sort.Slice(outcomes, func(i, j int) bool {
+		return outcomes[i].Run < outcomes[j].Run
+	})
+	return outcomes, failed, interrupted
+}
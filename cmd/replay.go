@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Div9851/new-warehouse-sim/config"
+	"github.com/Div9851/new-warehouse-sim/mapdata"
+	"github.com/Div9851/new-warehouse-sim/sim"
+	"github.com/Div9851/new-warehouse-sim/trajectory"
+)
+
+// runReplay は -record で書き出した軌跡を読み込み、再生して検証したうえで各ターンを表示する
+func runReplay(args []string) {
+	var (
+		flags      = flag.NewFlagSet("replay", flag.ExitOnError)
+		verifyOnly = flags.Bool("verify-only", false, "only verify the log without rendering it")
+		from       = flags.Int("from", 0, "first turn to render")
+		to         = flags.Int("to", -1, "last turn to render (-1 for the last turn)")
+	)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s replay [flags] trajectory.jsonl\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	path := flags.Arg(0)
+
+	f, err := os.Open(path)
+	if err != nil {
+		fatal(fmt.Errorf("can't open `%s` (%s)", path, err))
+	}
+	header, frames, err := trajectory.Read(f)
+	f.Close()
+	if err != nil {
+		fatal(fmt.Errorf("can't read `%s` (%s)", path, err))
+	}
+	mapData, err := mapdata.Parse(header.Map)
+	if err != nil {
+		fatal(fmt.Errorf("can't parse the map in `%s` (%s)", path, err))
+	}
+	mapData.Oracle, err = mapdata.NewOracle(header.Config.DistanceOracle, mapData)
+	if err != nil {
+		fatal(err)
+	}
+	if err := trajectory.Verify(header, frames, mapData); err != nil {
+		fatal(fmt.Errorf("`%s` is inconsistent (%s)", path, err))
+	}
+	if !*verifyOnly {
+		for _, frame := range frames {
+			if frame.Turn < *from || (*to >= 0 && frame.Turn > *to) {
+				continue
+			}
+			renderFrame(os.Stdout, mapData, header.Config, frame)
+		}
+	}
+	fmt.Printf("verified %d turns of `%s` (seed %d)\n", len(frames)-1, path, header.Seed)
+}
+
+// renderFrame は Simulator.Dump と同様の形式で frame を表示する
+func renderFrame(w io.Writer, mapData *mapdata.MapData, config *config.Config, frame *trajectory.Frame) {
+	fmt.Fprintf(w, "TURN %d:\n", frame.Turn)
+	rows := [][]byte{}
+	for _, row := range mapData.Text {
+		rows = append(rows, []byte(row))
+	}
+	for i, state := range frame.States {
+		rows[state.Pos.R][state.Pos.C] = sim.AgentGlyph(i)
+	}
+	for _, row := range rows {
+		fmt.Fprintln(w, string(row))
+	}
+	for _, exchange := range frame.Exchanges {
+		fmt.Fprintf(w, "[EXCHANGE] %v: agent %d -> agent %d\n", exchange.Pos, exchange.From, exchange.To)
+	}
+	for i, state := range frame.States {
+		fmt.Fprintf(w, "[AGENT %d] %c\n", i, sim.AgentGlyph(i))
+		if frame.Actions != nil {
+			fmt.Fprintf(w, "action: %s reward: %g\n", frame.Actions[i], frame.Rewards[i])
+		}
+		fmt.Fprintf(w, "pos: %v items: %d", state.Pos, state.NumItems)
+		if config.BatteryEnabled() {
+			fmt.Fprintf(w, " battery: %d/%d", state.Battery, config.BatteryCapacity)
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "assigned items: %v\n", frame.Items[i])
+		for _, spawn := range frame.Spawns {
+			if spawn.Agent == i {
+				fmt.Fprintf(w, "new item: %v\n", spawn.Pos)
+			}
+		}
+	}
+}
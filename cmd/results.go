@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Div9851/new-warehouse-sim/config"
+	"github.com/Div9851/new-warehouse-sim/mapdata"
+	"github.com/Div9851/new-warehouse-sim/sim"
+	"github.com/Div9851/new-warehouse-sim/stats"
+)
+
+// 結果の出力形式
+const (
+	outputText = "text"
+	outputJSON = "json"
+	outputCSV  = "csv"
+)
+
+// runOutcome は 1 回の実行の結果
+type runOutcome struct {
+	Run         int
+	Seed        int64
+	ItemsCount  []int
+	PickUpCount []int
+	ClearCount  []int
+	IterCount   []int
+	Metrics     *sim.Metrics
+}
+
+// MapIdentity は結果を得たマップのファイルと、その SHA-256
+// ハッシュはファイルそのものではなく、サイドカーや -depot, -shelf, -prune-unreachable を反映した後のマップから求める
+type MapIdentity struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// AgentResult は 1 回の実行でのエージェントごとの値
+type AgentResult struct {
+	Agent             int      `json:"agent"`
+	Items             int      `json:"items"`
+	Pickups           int      `json:"pickups"`
+	Clears            int      `json:"clears"`
+	ClearRate         *float64 `json:"clearRate"` // アイテムが 1 つも出現しなかった場合は nil
+	IterationsPerTurn float64  `json:"iterationsPerTurn"`
+	Collisions        int      `json:"collisions"`
+	StayTurns         int      `json:"stayTurns"`
+	IdleTurns         int      `json:"idleTurns"`
+	Distance          int      `json:"distance"`
+}
+
+// RunResult は 1 回の実行の値
+type RunResult struct {
+	Run               int           `json:"run"`
+	Seed              int64         `json:"seed"`
+	Agents            []AgentResult `json:"agents"`
+	SpawnToPickup     []int         `json:"spawnToPickup"`
+	PickupToClear     []int         `json:"pickupToClear"`
+	ExchangedItems    int           `json:"exchangedItems"`
+	ExchangeDistSaved int           `json:"exchangeDistSaved"`
+}
+
+// Summary は指標を実行 (遅延の場合はアイテム) にわたって集計した値
+// Agent が nil の場合は全エージェントの合計 (clearRate の場合は全体の割合) か、エージェントによらない指標
+type Summary struct {
+	Metric string   `json:"metric"`
+	Agent  *int     `json:"agent,omitempty"`
+	Avg    float64  `json:"avg"`
+	Var    float64  `json:"var"` // 母分散
+	N      int      `json:"n"`
+	SE     *float64 `json:"se,omitempty"`    // 平均の標準誤差 (値が 2 つ以上ある場合)
+	CILow  *float64 `json:"ciLow,omitempty"` // t 分布に基づく平均の 95% 信頼区間 (値が 2 つ以上ある場合)
+	CIHigh *float64 `json:"ciHigh,omitempty"`
+}
+
+// Results は cmd の出力する結果の全体
+type Results struct {
+	Map     MapIdentity    `json:"map"`
+	Config  *config.Config `json:"config"`
+	Runs    []RunResult    `json:"runs"`
+	Summary []Summary      `json:"summary"`
+}
+
+// mapSHA256 はシミュレーションで使うマップの各行を改行でつないだもののハッシュを返す
+func mapSHA256(mapData *mapdata.MapData) string {
+	sum := sha256.Sum256([]byte(strings.Join(mapData.Text, "\n") + "\n"))
+	return hex.EncodeToString(sum[:])
+}
+
+// ratio は a / b を返す
+// JSON は NaN を表せないので、b が 0 の場合は nil を返す
+func ratio(a int, b int) *float64 {
+	if b == 0 {
+		return nil
+	}
+	r := float64(a) / float64(b)
+	return &r
+}
+
+// buildResults は outcomes をまとめる
+// 結果を得た設定がわかるように、設定は省略した項目も既定値で埋めて持つ
+func buildResults(mapDataFile string, mapData *mapdata.MapData, config *config.Config, outcomes []runOutcome) *Results {
+	results := &Results{
+		Map:    MapIdentity{Path: mapDataFile, SHA256: mapSHA256(mapData)},
+		Config: effectiveConfig(config),
+	}
+	for _, outcome := range outcomes {
+		metrics := outcome.Metrics
+		runResult := RunResult{
+			Run:               outcome.Run,
+			Seed:              outcome.Seed,
+			SpawnToPickup:     append([]int{}, metrics.SpawnToPickup...),
+			PickupToClear:     append([]int{}, metrics.PickupToClear...),
+			ExchangedItems:    metrics.ExchangedItems,
+			ExchangeDistSaved: metrics.ExchangeDistSaved,
+		}
+		for i := 0; i < config.NumAgents; i++ {
+			runResult.Agents = append(runResult.Agents, AgentResult{
+				Agent:             i,
+				Items:             outcome.ItemsCount[i],
+				Pickups:           outcome.PickUpCount[i],
+				Clears:            outcome.ClearCount[i],
+				ClearRate:         ratio(outcome.ClearCount[i], outcome.ItemsCount[i]),
+				IterationsPerTurn: float64(outcome.IterCount[i]) / float64(config.LastTurn),
+				Collisions:        metrics.Collisions[i],
+				StayTurns:         metrics.StayTurns[i],
+				IdleTurns:         metrics.IdleTurns[i],
+				Distance:          metrics.Distance[i],
+			})
+		}
+		results.Runs = append(results.Runs, runResult)
+	}
+	results.summarize(config.NumAgents)
+	return results
+}
+
+func (results *Results) add(metric string, agent *int, s []float64) {
+	if len(s) == 0 {
+		return
+	}
+	w := stats.Of(s)
+	summary := Summary{Metric: metric, Agent: agent, Avg: w.Mean(), Var: w.Var(), N: w.N()}
+	if w.N() >= 2 {
+		se := w.StdErr()
+		lo, hi := w.TInterval(0.95)
+		summary.SE, summary.CILow, summary.CIHigh = &se, &lo, &hi
+	}
+	results.Summary = append(results.Summary, summary)
+}
+
+func (results *Results) summarize(numAgents int) {
+	perAgent := []struct {
+		metric string
+		value  func(agent *AgentResult) float64
+	}{
+		{"items", func(agent *AgentResult) float64 { return float64(agent.Items) }},
+		{"pickups", func(agent *AgentResult) float64 { return float64(agent.Pickups) }},
+		{"clears", func(agent *AgentResult) float64 { return float64(agent.Clears) }},
+		{"iterationsPerTurn", func(agent *AgentResult) float64 { return agent.IterationsPerTurn }},
+		{"collisions", func(agent *AgentResult) float64 { return float64(agent.Collisions) }},
+		{"stayTurns", func(agent *AgentResult) float64 { return float64(agent.StayTurns) }},
+		{"idleTurns", func(agent *AgentResult) float64 { return float64(agent.IdleTurns) }},
+		{"distance", func(agent *AgentResult) float64 { return float64(agent.Distance) }},
+	}
+	for _, m := range perAgent {
+		total := make([]float64, len(results.Runs))
+		for i := 0; i < numAgents; i++ {
+			s := make([]float64, len(results.Runs))
+			for run := range results.Runs {
+				s[run] = m.value(&results.Runs[run].Agents[i])
+				total[run] += s[run]
+			}
+			agent := i
+			results.add(m.metric, &agent, s)
+		}
+		results.add(m.metric, nil, total)
+	}
+	// 割合はアイテムが出現しなかった実行を除いて集計し、全体の割合は合計の個数から求める
+	var totalClearRate []float64
+	for i := 0; i < numAgents; i++ {
+		var s []float64
+		for _, run := range results.Runs {
+			if r := run.Agents[i].ClearRate; r != nil {
+				s = append(s, *r)
+			}
+		}
+		agent := i
+		results.add("clearRate", &agent, s)
+	}
+	for _, run := range results.Runs {
+		items, clears := 0, 0
+		for _, agent := range run.Agents {
+			items += agent.Items
+			clears += agent.Clears
+		}
+		if r := ratio(clears, items); r != nil {
+			totalClearRate = append(totalClearRate, *r)
+		}
+	}
+	results.add("clearRate", nil, totalClearRate)
+	var spawnToPickup, pickupToClear, exchanged, saved []float64
+	for _, run := range results.Runs {
+		for _, x := range run.SpawnToPickup {
+			spawnToPickup = append(spawnToPickup, float64(x))
+		}
+		for _, x := range run.PickupToClear {
+			pickupToClear = append(pickupToClear, float64(x))
+		}
+		exchanged = append(exchanged, float64(run.ExchangedItems))
+		saved = append(saved, float64(run.ExchangeDistSaved))
+	}
+	results.add("spawnToPickup", nil, spawnToPickup)
+	results.add("pickupToClear", nil, pickupToClear)
+	results.add("exchangedItems", nil, exchanged)
+	results.add("exchangeDistSaved", nil, saved)
+}
+
+func (results *Results) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
+}
+
+// csvHeader は writeCSV の書き出す表の列
+var csvHeader = []string{"map", "map_sha256", "run", "seed", "agent", "metric", "stat", "value"}
+
+// writeCSV は結果を 1 行に 1 つの値を持つ縦長の表として書き出す
+// 実行ごとの値は stat が value、集計した値は run と seed が空で stat が avg, var, n (と se, ciLow, ciHigh) の行になる
+// 設定は表に含めないので、writeResults が configPath のファイルに別に書き出す
+func (results *Results) writeCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	writer.Write(csvHeader)
+	results.eachRow(func(row []string) {
+		writer.Write(row)
+	})
+	writer.Flush()
+	return writer.Error()
+}
+
+// eachRow は writeCSV の表の各行を csvHeader の列の順に f に渡す
+func (results *Results) eachRow(f func(row []string)) {
+	row := func(run string, seed string, agent string, metric string, stat string, value string) {
+		f([]string{results.Map.Path, results.Map.SHA256, run, seed, agent, metric, stat, value})
+	}
+	itoa := strconv.Itoa
+	ftoa := func(x float64) string {
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	}
+	for _, run := range results.Runs {
+		r, seed := itoa(run.Run), strconv.FormatInt(run.Seed, 10)
+		for _, agent := range run.Agents {
+			a := itoa(agent.Agent)
+			row(r, seed, a, "items", "value", itoa(agent.Items))
+			row(r, seed, a, "pickups", "value", itoa(agent.Pickups))
+			row(r, seed, a, "clears", "value", itoa(agent.Clears))
+			clearRate := ""
+			if agent.ClearRate != nil {
+				clearRate = ftoa(*agent.ClearRate)
+			}
+			row(r, seed, a, "clearRate", "value", clearRate)
+			row(r, seed, a, "iterationsPerTurn", "value", ftoa(agent.IterationsPerTurn))
+			row(r, seed, a, "collisions", "value", itoa(agent.Collisions))
+			row(r, seed, a, "stayTurns", "value", itoa(agent.StayTurns))
+			row(r, seed, a, "idleTurns", "value", itoa(agent.IdleTurns))
+			row(r, seed, a, "distance", "value", itoa(agent.Distance))
+		}
+		for _, x := range run.SpawnToPickup {
+			row(r, seed, "", "spawnToPickup", "value", itoa(x))
+		}
+		for _, x := range run.PickupToClear {
+			row(r, seed, "", "pickupToClear", "value", itoa(x))
+		}
+		row(r, seed, "", "exchangedItems", "value", itoa(run.ExchangedItems))
+		row(r, seed, "", "exchangeDistSaved", "value", itoa(run.ExchangeDistSaved))
+	}
+	for _, summary := range results.Summary {
+		agent := "total"
+		if summary.Agent != nil {
+			agent = itoa(*summary.Agent)
+		}
+		row("", "", agent, summary.Metric, "avg", ftoa(summary.Avg))
+		row("", "", agent, summary.Metric, "var", ftoa(summary.Var))
+		row("", "", agent, summary.Metric, "n", itoa(summary.N))
+		if summary.SE != nil {
+			row("", "", agent, summary.Metric, "se", ftoa(*summary.SE))
+			row("", "", agent, summary.Metric, "ciLow", ftoa(*summary.CILow))
+			row("", "", agent, summary.Metric, "ciHigh", ftoa(*summary.CIHigh))
+		}
+	}
+}
+
+// configPath は CSV の結果の path に対応する設定のファイルのパスを返す (results.csv -> results.config.json)
+func configPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".config.json"
+}
+
+// createAndWrite は path のファイルに write で書き出し、閉じる際のエラーも返す
+func createAndWrite(path string, write func(w io.Writer) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("can't create `%s` (%s)", path, err)
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		return fmt.Errorf("can't write `%s` (%s)", path, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("can't write `%s` (%s)", path, err)
+	}
+	return nil
+}
+
+// writeConfigFile は CSV の結果の path に対応する設定のファイルに v を JSON で書き出す
+func writeConfigFile(path string, v interface{}) error {
+	return createAndWrite(configPath(path), func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	})
+}
+
+// writeResults は outcomes を format の形式で path (空の場合は標準出力) に書き出す
+// CSV をファイルに書き出す場合は、設定を configPath のファイルに書き出す
+func writeResults(format string, path string, mapDataFile string, mapData *mapdata.MapData, config *config.Config, outcomes []runOutcome) error {
+	results := buildResults(mapDataFile, mapData, config, outcomes)
+	write := results.writeCSV
+	if format == outputJSON {
+		write = results.writeJSON
+	}
+	if path == "" {
+		if err := write(os.Stdout); err != nil {
+			return fmt.Errorf("can't write results (%s)", err)
+		}
+		return nil
+	}
+	if err := createAndWrite(path, write); err != nil {
+		return err
+	}
+	if format == outputCSV {
+		return writeConfigFile(path, results.Config)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/Div9851/new-warehouse-sim/sim"
+	"github.com/Div9851/new-warehouse-sim/trajectory"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+// frameStore は Web ページに渡す軌跡の各行を保持する
+// 実行中のシミュレーションの Recorder の書き込み先としても使う
+type frameStore struct {
+	mu      sync.Mutex
+	lines   []json.RawMessage // 1 行目が Header、2 行目以降が Frame
+	pending []byte
+	done    bool
+}
+
+func (store *frameStore) Write(p []byte) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.pending = append(store.pending, p...)
+	for {
+		i := bytes.IndexByte(store.pending, '\n')
+		if i < 0 {
+			break
+		}
+		if i > 0 {
+			line := make(json.RawMessage, i)
+			copy(line, store.pending[:i])
+			store.lines = append(store.lines, line)
+		}
+		store.pending = store.pending[i+1:]
+	}
+	return len(p), nil
+}
+
+// finish はこれ以上 Frame が増えないことを記録する
+func (store *frameStore) finish() {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.done = true
+}
+
+func (store *frameStore) serveHeader(w http.ResponseWriter, r *http.Request) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.lines) == 0 {
+		http.Error(w, "simulation has not started yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(store.lines[0])
+}
+
+// serveFrames は from ターン目以降の Frame と、シミュレーションが終わっているかどうかを返す
+func (store *frameStore) serveFrames(w http.ResponseWriter, r *http.Request) {
+	from, err := strconv.Atoi(r.URL.Query().Get("from"))
+	if err != nil || from < 0 {
+		from = 0
+	}
+	store.mu.Lock()
+	frames := []json.RawMessage{}
+	if 1+from < len(store.lines) {
+		frames = store.lines[1+from:]
+	}
+	resp := struct {
+		Frames []json.RawMessage `json:"frames"`
+		Done   bool              `json:"done"`
+	}{frames, store.done}
+	data, err := json.Marshal(resp)
+	store.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// runServe は軌跡をブラウザで見るための Web ページを提供する
+// 引数に -record で書き出した軌跡を与えた場合はそれを、
+// -mapdata-file と -config-file を与えた場合はその場で実行するシミュレーションを表示する
+func runServe(args []string) {
+	var (
+		flags  = flag.NewFlagSet("serve", flag.ExitOnError)
+		addr   = flags.String("addr", "localhost:8080", "address to listen on")
+		inputs inputOptions
+	)
+	inputs.addFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s serve [flags] trajectory.jsonl\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "       %s serve [flags] -mapdata-file FILE -config-file FILE\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	store := &frameStore{}
+	switch {
+	case flags.NArg() == 1:
+		path := flags.Arg(0)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			fatal(fmt.Errorf("can't read `%s` (%s)", path, err))
+		}
+		if _, _, err := trajectory.Read(bytes.NewReader(data)); err != nil {
+			fatal(fmt.Errorf("can't read `%s` (%s)", path, err))
+		}
+		store.Write(data)
+		store.Write([]byte("\n"))
+		store.finish()
+	case flags.NArg() == 0 && inputs.mapDataFile != "":
+		mapData, config, err := inputs.load()
+		if err != nil {
+			fatal(err)
+		}
+		s, err := sim.New(mapData, config, false, config.RandSeed)
+		if err != nil {
+			fatal(err)
+		}
+		s.Recorder = trajectory.NewRecorder(store, &trajectory.Header{Map: mapData.Text, Config: effectiveConfig(config), Seed: config.RandSeed})
+		go func() {
+			s.Run()
+			store.finish()
+		}()
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	static, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(static)))
+	mux.HandleFunc("/api/header", store.serveHeader)
+	mux.HandleFunc("/api/frames", store.serveFrames)
+	fmt.Printf("serving on http://%s/\n", *addr)
+	if err := http.ListenAndServe(*addr, mux); err != nil {
+		fatal(err)
+	}
+}
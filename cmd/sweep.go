@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/Div9851/new-warehouse-sim/config"
+)
+
+// axis は掃引する設定の項目 (JSON のキー) とその値 (JSON)
+type axis struct {
+	Key    string
+	Values []json.RawMessage
+}
+
+// axisList は "key=v1,v2,..." か "key=start:stop:step" の形式で繰り返し指定できるフラグ
+type axisList []axis
+
+func (list *axisList) String() string {
+	var s []string
+	for _, a := range *list {
+		s = append(s, a.Key)
+	}
+	return strings.Join(s, " ")
+}
+
+func (list *axisList) Set(value string) error {
+	a, err := parseAxis(value)
+	if err != nil {
+		return err
+	}
+	*list = append(*list, a)
+	return nil
+}
+
+func parseAxis(value string) (axis, error) {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return axis{}, fmt.Errorf("expected `key=v1,v2,...` or `key=start:stop:step` but got `%s`", value)
+	}
+	a := axis{Key: value[:i]}
+	if _, ok := configKeys()[a.Key]; !ok {
+		return axis{}, fmt.Errorf("unknown config key `%s`", a.Key)
+	}
+	spec := value[i+1:]
+	if r := strings.Split(spec, ":"); len(r) == 3 {
+		var bounds [3]float64
+		for k := range r {
+			x, err := strconv.ParseFloat(r[k], 64)
+			if err != nil {
+				return axis{}, fmt.Errorf("can't parse range `%s` of `%s` (%s)", spec, a.Key, err)
+			}
+			bounds[k] = x
+		}
+		start, stop, step := bounds[0], bounds[1], bounds[2]
+		if step == 0 || (stop-start)/step < 0 {
+			return axis{}, fmt.Errorf("range `%s` of `%s` is empty", spec, a.Key)
+		}
+		// 誤差で stop を取りこぼさないように、区間の数は丸めてから数える
+		n := int(math.Floor((stop-start)/step + 1e-9))
+		// 0.1 を足し重ねた 0.30000000000000004 のような値にならないよう、start と step の小数の桁数で丸める
+		prec := decimals(r[0])
+		if p := decimals(r[2]); p > prec {
+			prec = p
+		}
+		for k := 0; k <= n; k++ {
+			x := start + float64(k)*step
+			a.Values = append(a.Values, json.RawMessage(formatDecimal(x, prec)))
+		}
+		return a, nil
+	}
+	for _, s := range strings.Split(spec, ",") {
+		a.Values = append(a.Values, parseValue(s))
+	}
+	return a, nil
+}
+
+// decimals は数値の文字列 s を小数で書いた場合の小数点以下の桁数を返す (1.25 -> 2, 5e-3 -> 3)
+func decimals(s string) int {
+	exp := 0
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		exp, _ = strconv.Atoi(s[i+1:])
+		s = s[:i]
+	}
+	n := 0
+	if i := strings.Index(s, "."); i >= 0 {
+		n = len(s) - i - 1
+	}
+	if n -= exp; n < 0 {
+		return 0
+	}
+	return n
+}
+
+// formatDecimal は x を小数点以下 prec 桁に丸め、末尾の 0 を除いて書く
+// 整数の項目にも使えるように、1.50 は 1.5、2.0 は 2 にする
+func formatDecimal(x float64, prec int) string {
+	s := strconv.FormatFloat(x, 'f', prec, 64)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	}
+	if s == "-0" {
+		s = "0"
+	}
+	return s
+}
+
+// sweepPoint は掃引する設定の 1 つの組み合わせとその結果
+type sweepPoint struct {
+	Params map[string]json.RawMessage `json:"params"`
+	*Results
+}
+
+// sweepPoints は axes の値の直積を、最初の軸が最も遅く変わる順に返す
+func sweepPoints(axes []axis) [][]json.RawMessage {
+	points := [][]json.RawMessage{nil}
+	for _, a := range axes {
+		var next [][]json.RawMessage
+		for _, point := range points {
+			for _, value := range a.Values {
+				next = append(next, append(append([]json.RawMessage{}, point...), value))
+			}
+		}
+		points = next
+	}
+	return points
+}
+
+// pointConfig は base の JSON の axes の項目を values で置き換えた設定を返す
+func pointConfig(base []byte, axes []axis, values []json.RawMessage) (*config.Config, error) {
+	var overrides []override
+	for i, a := range axes {
+		overrides = append(overrides, override{Key: a.Key, Value: values[i]})
+	}
+	b, err := applyOverrides(base, overrides)
+	if err != nil {
+		return nil, err
+	}
+	return config.Decode(bytes.NewReader(b))
+}
+
+// csvValue は JSON の値を表に書く文字列にする (文字列は引用符を外す)
+func csvValue(value json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+		return s
+	}
+	return string(value)
+}
+
+// runSweep は基本の設定の一部の項目を掃引し、各組み合わせを -run 回ずつ実行した結果を 1 つの表に書き出す
+func runSweep(args []string) {
+	var (
+		flags      = flag.NewFlagSet("sweep", flag.ExitOnError)
+		Run        = flags.Int("run", 1, "number of runs for each combination")
+		parallel   = flags.Int("parallel", runtime.NumCPU(), "maximum number of runs executed at the same time")
+		format     = flags.String("output-format", outputCSV, "format of results (json or csv)")
+		outputFile = flags.String("output-file", "", "path of results file (default: stdout); csv also writes the base config next to it as <name>.config.json")
+		axes       axisList
+		inputs     inputOptions
+	)
+	inputs.addFlags(flags)
+	flags.Var(&axes, "axis", "config key and values to sweep as `key=values`, where values is v1,v2,... or start:stop:step (repeatable)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s sweep [flags]\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "example: %s sweep -mapdata-file testdata/mapdata/warehouse-medium -config-file testdata/config/default.json -axis penalty=-10:-40:-10 -axis requestStrategy=NEAREST_FROM_DEPOT,RANDOM -run 10\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if len(axes) == 0 {
+		fatal(fmt.Errorf("no -axis given"))
+	}
+	if *parallel < 1 {
+		fatal(fmt.Errorf("-parallel must be positive"))
+	}
+	if *format != outputJSON && *format != outputCSV {
+		fatal(fmt.Errorf("unknown output format `%s`", *format))
+	}
+
+	mapData, err := loadMapData(inputs.mapDataFile, &inputs.mapOpts)
+	if err != nil {
+		fatal(err)
+	}
+	// -set と環境変数による上書きは全ての組み合わせに共通する
+	base, err := inputs.readConfig(inputs.configFile)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "base config: %s\n", base)
+	// 実行を始める前に全ての組み合わせを確かめる
+	values := sweepPoints(axes)
+	configs := make([]*config.Config, len(values))
+	for i, point := range values {
+		if configs[i], err = pointConfig(base, axes, point); err != nil {
+			fatal(fmt.Errorf("invalid config `%s` with %s (%s)", inputs.configFile, describePoint(axes, point), err))
+		}
+		if err := inputs.check(mapData, configs[i]); err != nil {
+			fatal(fmt.Errorf("%s: %s", describePoint(axes, point), err))
+		}
+	}
+
+	// 長い掃引の後で書き出せないことに気づかないよう、ファイルは先に作っておく
+	var out *os.File
+	if *outputFile != "" {
+		if out, err = os.Create(*outputFile); err != nil {
+			fatal(fmt.Errorf("can't create `%s` (%s)", *outputFile, err))
+		}
+	}
+	oracles := newOracleCache(mapData)
+	progress := os.Stderr
+	var points []sweepPoint
+	failed, interrupted := 0, false
+	for i, point := range values {
+		fmt.Fprintf(progress, "=== point %d/%d: %s ===\n", i+1, len(values), describePoint(axes, point))
+		pointMap, err := oracles.mapFor(configs[i])
+		if err != nil {
+			fatal(err)
+		}
+		outcomes, f, stopped := runPool(*Run, *parallel, progress, runner(pointMap, configs[i], *Run, false, ""))
+		failed += f
+		if len(outcomes) > 0 {
+			results := buildResults(inputs.mapDataFile, pointMap, configs[i], outcomes)
+			params := make(map[string]json.RawMessage)
+			for k, a := range axes {
+				params[a.Key] = point[k]
+			}
+			points = append(points, sweepPoint{Params: params, Results: results})
+		}
+		if stopped {
+			interrupted = true
+			break
+		}
+	}
+	if out == nil {
+		if err := writeSweep(os.Stdout, *format, axes, points); err != nil {
+			fatal(fmt.Errorf("can't write results (%s)", err))
+		}
+	} else {
+		err := writeSweep(out, *format, axes, points)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			fatal(fmt.Errorf("can't write `%s` (%s)", *outputFile, err))
+		}
+		if *format == outputCSV {
+			if err := writeConfigFile(*outputFile, baseConfig(base)); err != nil {
+				fatal(err)
+			}
+		}
+	}
+	if interrupted {
+		os.Exit(130)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// baseConfig は基本の設定 base を、省略した項目を既定値で埋めて返す
+// 掃引する項目によっては base だけでは不正な場合があるので検証はしない
+func baseConfig(base []byte) interface{} {
+	c := config.Default()
+	if err := json.Unmarshal(base, &c); err != nil {
+		return json.RawMessage(base)
+	}
+	return effectiveConfig(&c)
+}
+
+func describePoint(axes []axis, values []json.RawMessage) string {
+	var s []string
+	for i, a := range axes {
+		s = append(s, fmt.Sprintf("%s=%s", a.Key, csvValue(values[i])))
+	}
+	return strings.Join(s, " ")
+}
+
+// writeSweep は points を 1 つの表に書き出す
+// CSV の場合は writeCSV の表の map_sha256 と run の間に掃引した項目の列を加える
+// 基本の設定は表に含めないので、runSweep が configPath のファイルに別に書き出す
+func writeSweep(w io.Writer, format string, axes []axis, points []sweepPoint) error {
+	if format == outputJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(points)
+	}
+	writer := csv.NewWriter(w)
+	header := append([]string{}, csvHeader[:2]...)
+	for _, a := range axes {
+		header = append(header, a.Key)
+	}
+	writer.Write(append(header, csvHeader[2:]...))
+	for _, point := range points {
+		var params []string
+		for _, a := range axes {
+			params = append(params, csvValue(point.Params[a.Key]))
+		}
+		point.eachRow(func(row []string) {
+			out := append(append(append([]string{}, row[:2]...), params...), row[2:]...)
+			writer.Write(out)
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
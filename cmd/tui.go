@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Div9851/new-warehouse-sim/mapdata"
+	"github.com/Div9851/new-warehouse-sim/sim"
+)
+
+// エージェントを塗り分ける 256 色のパレット
+// エージェントがこれより多い場合は繰り返して使う
+var agentColors = []int{196, 46, 33, 226, 201, 51, 208, 129, 118, 27, 214, 165, 85, 160, 39, 220, 99, 48, 203, 63}
+
+const (
+	ansiReset      = "\x1b[0m"
+	ansiHome       = "\x1b[H"
+	ansiClear      = "\x1b[2J"
+	ansiClearLine  = "\x1b[K"
+	ansiClearBelow = "\x1b[J"
+	ansiHideCursor = "\x1b[?25l"
+	ansiShowCursor = "\x1b[?25h"
+)
+
+func agentColor(id int) int {
+	return agentColors[id%len(agentColors)]
+}
+
+// 各セルの背景色 (256 色)
+var cellBackground = map[byte]int{
+	mapdata.Wall:    240,
+	mapdata.Shelf:   94,
+	mapdata.Depot:   28,
+	mapdata.Charger: 136,
+}
+
+// runTUI は sim を端末上で 1 ターンずつ描き直しながら進める
+// スペースで実行と一時停止を切り替え、n で 1 ターン進め、+ と - で速さを変え、q で終了する
+func runTUI(s *sim.Simulator) error {
+	restore, err := setRawTerminal()
+	if err != nil {
+		return err
+	}
+	defer restore()
+	fmt.Print(ansiHideCursor + ansiClear)
+	defer fmt.Print(ansiReset + ansiShowCursor)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	keys := make(chan byte)
+	go func() {
+		reader := bufio.NewReader(os.Stdin)
+		for {
+			key, err := reader.ReadByte()
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- key
+		}
+	}()
+
+	running := false
+	delay := 200 * time.Millisecond
+	ticker := time.NewTicker(delay)
+	defer ticker.Stop()
+	for {
+		drawTUI(s, running, delay)
+		select {
+		case <-sigs:
+			return nil
+		case key, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			switch key {
+			case 'q':
+				return nil
+			case ' ':
+				running = !running
+			case 'n', '.':
+				running = false
+				if s.Turn < s.Config.LastTurn {
+					s.Step()
+				}
+			case '+':
+				if delay > 10*time.Millisecond {
+					delay /= 2
+					ticker.Reset(delay)
+				}
+			case '-':
+				if delay < 5*time.Second {
+					delay *= 2
+					ticker.Reset(delay)
+				}
+			}
+		case <-ticker.C:
+			if !running {
+				continue
+			}
+			if s.Turn < s.Config.LastTurn {
+				s.Step()
+			} else {
+				running = false
+			}
+		}
+	}
+}
+
+// setRawTerminal は端末をキー入力を 1 文字ずつ読めるモードにし、元に戻す関数を返す
+func setRawTerminal() (func(), error) {
+	stty := func(args ...string) (string, error) {
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = os.Stdin
+		out, err := cmd.Output()
+		return strings.TrimSpace(string(out)), err
+	}
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, fmt.Errorf("can't get terminal state (%s)", err)
+	}
+	if _, err := stty("cbreak", "-echo"); err != nil {
+		return nil, fmt.Errorf("can't set terminal mode (%s)", err)
+	}
+	return func() {
+		stty(saved)
+	}, nil
+}
+
+// drawTUI は画面の左にマップ、右にエージェントごとの情報を描く
+func drawTUI(s *sim.Simulator, running bool, delay time.Duration) {
+	owner := make(map[mapdata.Pos]int)
+	count := make(map[mapdata.Pos]int)
+	for id, items := range s.Items {
+		for pos, cnt := range items {
+			owner[pos] = id
+			count[pos] += cnt
+		}
+	}
+	agentAt := make(map[mapdata.Pos]int)
+	for id, state := range s.States {
+		agentAt[state.Pos] = id
+	}
+
+	var left []string
+	for r, row := range s.MapData.Text {
+		var line strings.Builder
+		for c := 0; c < len(row); c++ {
+			pos := mapdata.Pos{R: r, C: c}
+			ch := row[c]
+			bg, hasBg := cellBackground[ch]
+			if hasBg {
+				fmt.Fprintf(&line, "\x1b[48;5;%dm", bg)
+			}
+			if id, ok := agentAt[pos]; ok {
+				// エージェントはその色を背景にして太字で描く
+				fmt.Fprintf(&line, "\x1b[1;30;48;5;%dm%c", agentColor(id), sim.AgentGlyph(id))
+			} else if id, ok := owner[pos]; ok {
+				glyph := byte('*')
+				if count[pos] > 1 && count[pos] < 10 {
+					glyph = byte('0' + count[pos])
+				}
+				fmt.Fprintf(&line, "\x1b[1;38;5;%dm%c", agentColor(id), glyph)
+			} else {
+				line.WriteByte(ch)
+			}
+			line.WriteString(ansiReset)
+		}
+		left = append(left, line.String())
+	}
+
+	state := "paused"
+	if running {
+		state = "running"
+	}
+	right := []string{
+		fmt.Sprintf("TURN %d/%d  [%s, %v/turn]", s.Turn, s.Config.LastTurn, state, delay),
+		"space: run/pause  n: step  +/-: speed  q: quit",
+		"",
+		"AGENT  POS       CARRY  ASSIGNED  PICKUP  CLEAR  LAST",
+	}
+	for id, st := range s.States {
+		last := "-"
+		if len(s.LastActions) > 0 {
+			last = s.LastActions[id].ToStr()
+		}
+		assigned := 0
+		for _, cnt := range s.Items[id] {
+			assigned += cnt
+		}
+		line := fmt.Sprintf("\x1b[1;38;5;%dm%c\x1b[0m %-4d %-9s %-6d %-9d %-7d %-6d %s",
+			agentColor(id), sim.AgentGlyph(id), id, fmt.Sprintf("(%d,%d)", st.Pos.R, st.Pos.C), st.NumItems, assigned, s.PickUpCount[id], s.ClearCount[id], last)
+		if s.Config.BatteryEnabled() {
+			line += fmt.Sprintf("  battery %d/%d", st.Battery, s.Config.BatteryCapacity)
+		}
+		right = append(right, line)
+	}
+	if len(s.LastExchanges) > 0 {
+		right = append(right, "", "EXCHANGES")
+		for _, exchange := range s.LastExchanges {
+			right = append(right, fmt.Sprintf("(%d,%d): %d -> %d", exchange.Pos.R, exchange.Pos.C, exchange.From, exchange.To))
+		}
+	}
+
+	var out strings.Builder
+	out.WriteString(ansiHome)
+	width := len(s.MapData.Text[0])
+	for i := 0; i < len(left) || i < len(right); i++ {
+		if i < len(left) {
+			out.WriteString(left[i])
+		} else {
+			out.WriteString(strings.Repeat(" ", width))
+		}
+		if i < len(right) {
+			out.WriteString("   ")
+			out.WriteString(right[i])
+		}
+		out.WriteString(ansiClearLine + "\n")
+	}
+	out.WriteString(ansiClearBelow)
+	fmt.Print(out.String())
+}
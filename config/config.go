@@ -1,18 +1,226 @@
 package config
 
+import "math"
+
+// DepotStrategy は荷物交換で候補のアイテムをデポからの距離によって選ぶ戦略 (RequestStrategy と AcceptStrategy)
+type DepotStrategy string
+
+const (
+	NearestFromDepot  DepotStrategy = "NEAREST_FROM_DEPOT"
+	FarthestFromDepot DepotStrategy = "FARTHEST_FROM_DEPOT"
+	RandomItem        DepotStrategy = "RANDOM"
+)
+
+// LoadStrategy は荷物交換で受け取るエージェントを負荷によって選ぶ戦略 (NominateStrategy)
+type LoadStrategy string
+
+const (
+	LowestLoad  LoadStrategy = "LOWEST_LOAD"
+	HighestLoad LoadStrategy = "HIGHEST_LOAD"
+	RandomAgent LoadStrategy = "RANDOM"
+)
+
+// DefaultPolicy は Policy が未指定の場合に使う方策 (policy が実装する)
+const DefaultPolicy = "FDUCT"
+
+// 行動選択の規則 (fduct が実装する)
+const (
+	UCB1      = "UCB1"
+	UCB1Tuned = "UCB1_TUNED"
+	PUCT      = "PUCT"
+	EXP3      = "EXP3"
+)
+
+// 距離のオラクルの種類 (mapdata が実装する)
+const (
+	LazyOracle     = "LAZY"
+	DenseOracle    = "DENSE"
+	LandmarkOracle = "LANDMARK"
+)
+
 type Config struct {
-	NumAgents        int     `json:"numAgents"`
-	LastTurn         int     `json:"lastTurn"`
-	NewItemProb      float64 `json:"newItemProb"`
-	NumIters         int     `json:"numIters"`
-	MaxDepth         int     `json:"maxDepth"`
-	ExpandThresh     int     `json:"expandThresh"`
-	Reward           float64 `json:"reward"`
-	Penalty          float64 `json:"penalty"`
-	DiscountFactor   float64 `json:"discountFactor"`
-	RandSeed         int64   `json:"randSeed"`
-	EnableExchange   bool    `json:"enableExchange,omitempty"`
-	RequestStrategy  string  `json:"requestStrategy,omitempty"`
-	AcceptStrategy   string  `json:"acceptStrategy,omitempty"`
-	NominateStrategy string  `json:"nominateStrategy,omitempty"`
+	Policy           string        `json:"policy,omitempty"`
+	NumAgents        int           `json:"numAgents"`
+	LastTurn         int           `json:"lastTurn"`
+	NewItemProb      float64       `json:"newItemProb"`
+	NumIters         int           `json:"numIters"`
+	PlanningTimeMs   int           `json:"planningTimeMs,omitempty"`
+	ReuseTree        bool          `json:"reuseTree,omitempty"`
+	NumWorkers       int           `json:"numWorkers,omitempty"`
+	TreeParallel     bool          `json:"treeParallel,omitempty"`
+	VirtualLoss      int           `json:"virtualLoss,omitempty"`
+	MaxDepth         int           `json:"maxDepth"`
+	ExpandThresh     int           `json:"expandThresh"`
+	Selection        string        `json:"selection,omitempty"`
+	ExplorationConst float64       `json:"explorationConst,omitempty"`
+	NormalizeReward  bool          `json:"normalizeReward,omitempty"`
+	Reward           float64       `json:"reward"`
+	Penalty          float64       `json:"penalty"`
+	DiscountFactor   float64       `json:"discountFactor"`
+	RandSeed         int64         `json:"randSeed"`
+	EnableExchange   bool          `json:"enableExchange,omitempty"`
+	RequestStrategy  DepotStrategy `json:"requestStrategy,omitempty"`
+	AcceptStrategy   DepotStrategy `json:"acceptStrategy,omitempty"`
+	NominateStrategy LoadStrategy  `json:"nominateStrategy,omitempty"`
+	ShelfPickOnly    bool          `json:"shelfPickOnly,omitempty"`
+	DistanceOracle   string        `json:"distanceOracle,omitempty"`
+	Capacity         int           `json:"capacity,omitempty"`
+	BatteryCapacity  int           `json:"batteryCapacity,omitempty"`
+	MoveCost         int           `json:"moveCost,omitempty"`
+	ItemCost         int           `json:"itemCost,omitempty"`
+	ChargeRate       int           `json:"chargeRate,omitempty"`
+	DepletedPenalty  float64       `json:"depletedPenalty,omitempty"`
+	BatteryBucket    int           `json:"batteryBucket,omitempty"`
+}
+
+// PolicyName は使う方策の名前を返す (未指定の場合は DefaultPolicy)
+func (config *Config) PolicyName() string {
+	if config.Policy == "" {
+		return DefaultPolicy
+	}
+	return config.Policy
+}
+
+// SelectionRule は行動選択の規則を返す (未指定の場合は UCB1)
+func (config *Config) SelectionRule() string {
+	if config.Selection == "" {
+		return UCB1
+	}
+	return config.Selection
+}
+
+// Exploration は行動選択の探索の強さを返す (未指定の場合は規則ごとの既定値)
+func (config *Config) Exploration() float64 {
+	if config.ExplorationConst > 0 {
+		return config.ExplorationConst
+	}
+	switch config.SelectionRule() {
+	case UCB1:
+		return math.Sqrt2
+	case EXP3:
+		return 0.1 // 一様に探索する確率
+	}
+	return 1
+}
+
+// CarryCapacity はエージェントが同時に運べるアイテムの数を返す (未指定の場合は 1)
+func (config *Config) CarryCapacity() int {
+	if config.Capacity <= 0 {
+		return 1
+	}
+	return config.Capacity
+}
+
+// Workers はエージェント 1 体の探索に使う木 (ゴルーチン) の数を返す (未指定の場合は 1)
+func (config *Config) Workers() int {
+	if config.NumWorkers <= 0 {
+		return 1
+	}
+	return config.NumWorkers
+}
+
+// VirtualLosses は木並列化で探索中の行動に加える仮想損失の回数を返す (未指定の場合は 1)
+func (config *Config) VirtualLosses() int {
+	if config.VirtualLoss <= 0 {
+		return 1
+	}
+	return config.VirtualLoss
+}
+
+// Oracle は距離のオラクルの種類を返す (未指定の場合は LAZY)
+func (config *Config) Oracle() string {
+	if config.DistanceOracle == "" {
+		return LazyOracle
+	}
+	return config.DistanceOracle
+}
+
+// BatteryEnabled はバッテリーのモデルを使うかどうかを返す (BatteryCapacity が 0 の場合は使わない)
+func (config *Config) BatteryEnabled() bool {
+	return config.BatteryCapacity > 0
+}
+
+// BatteryMoveCost は 1 マス移動するときに消費するバッテリーを返す (未指定の場合は 1)
+func (config *Config) BatteryMoveCost() int {
+	if config.MoveCost <= 0 {
+		return 1
+	}
+	return config.MoveCost
+}
+
+// MoveBatteryCost は numItems 個のアイテムを運んで 1 マス移動するときに消費するバッテリーを返す
+func (config *Config) MoveBatteryCost(numItems int) int {
+	return config.BatteryMoveCost() + config.ItemCost*numItems
+}
+
+// BatteryChargeRate は 1 ターンの充電で回復するバッテリーを返す (未指定の場合は容量の 1/10)
+func (config *Config) BatteryChargeRate() int {
+	if config.ChargeRate > 0 {
+		return config.ChargeRate
+	}
+	if config.BatteryCapacity < 10 {
+		return 1
+	}
+	return config.BatteryCapacity / 10
+}
+
+// BatteryDepletedPenalty はバッテリーが切れて充電器のない位置で動けなくなったエージェントに毎ターン与える報酬を返す (未指定の場合は -Reward)
+func (config *Config) BatteryDepletedPenalty() float64 {
+	if config.DepletedPenalty != 0 {
+		return config.DepletedPenalty
+	}
+	return -config.Reward
+}
+
+// BatteryBucketSize は探索木の節点でまとめて扱うバッテリー残量の幅を返す (未指定の場合は BatteryChargeRate)
+func (config *Config) BatteryBucketSize() int {
+	if config.BatteryBucket > 0 {
+		return config.BatteryBucket
+	}
+	return config.BatteryChargeRate()
+}
+
+// RewardScale は報酬の正規化に使う値として、1 ターンに得られる報酬の絶対値の最大値を返す
+func (config *Config) RewardScale() float64 {
+	scale := math.Abs(config.Reward) * float64(config.CarryCapacity())
+	scale = math.Max(scale, math.Abs(config.Penalty))
+	if config.BatteryEnabled() {
+		scale = math.Max(scale, math.Abs(config.BatteryDepletedPenalty()))
+	}
+	if scale == 0 {
+		return 1
+	}
+	return scale
+}
+
+// ReturnScale は MaxDepth ターンの割引累積報酬の絶対値の上限 RewardScale * (1 - γ^MaxDepth) / (1 - γ) を返す
+func (config *Config) ReturnScale() float64 {
+	horizon := float64(config.MaxDepth)
+	if config.DiscountFactor < 1 {
+		horizon = (1 - math.Pow(config.DiscountFactor, float64(config.MaxDepth))) / (1 - config.DiscountFactor)
+	}
+	if horizon < 1 {
+		horizon = 1
+	}
+	return config.RewardScale() * horizon
+}
+
+// Effective は未指定の項目を実際に使う既定値で埋めた設定を返す
+// バッテリーの項目はバッテリーのモデルを使う場合だけ埋める
+func (config *Config) Effective() Config {
+	effective := *config
+	effective.Policy = config.PolicyName()
+	effective.NumWorkers = config.Workers()
+	effective.VirtualLoss = config.VirtualLosses()
+	effective.Selection = config.SelectionRule()
+	effective.ExplorationConst = config.Exploration()
+	effective.DistanceOracle = config.Oracle()
+	effective.Capacity = config.CarryCapacity()
+	if config.BatteryEnabled() {
+		effective.MoveCost = config.BatteryMoveCost()
+		effective.ChargeRate = config.BatteryChargeRate()
+		effective.DepletedPenalty = config.BatteryDepletedPenalty()
+		effective.BatteryBucket = config.BatteryBucketSize()
+	}
+	return effective
 }
@@ -0,0 +1,150 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Default は設定ファイルで省略された項目に使う値を返す
+// 省略可能な項目 (omitempty) は 0 値のままにし、既定値は各メソッドで補う
+func Default() Config {
+	return Config{
+		NumAgents:      3,
+		LastTurn:       100,
+		NewItemProb:    0.1,
+		NumIters:       20000,
+		MaxDepth:       20,
+		ExpandThresh:   2,
+		Reward:         100,
+		Penalty:        -5,
+		DiscountFactor: 0.9,
+		RandSeed:       123,
+	}
+}
+
+// Decode は r から JSON の設定を読み、Default に重ねたうえで Validate する
+// 知らない項目がある場合はエラーにする
+func Decode(r io.Reader) (*Config, error) {
+	config := Default()
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+var (
+	depotStrategies = []DepotStrategy{NearestFromDepot, FarthestFromDepot, RandomItem}
+	loadStrategies  = []LoadStrategy{LowestLoad, HighestLoad, RandomAgent}
+	selections      = []string{UCB1, UCB1Tuned, PUCT, EXP3}
+	distanceOracles = []string{LazyOracle, DenseOracle, LandmarkOracle}
+)
+
+var (
+	policyNamesMu sync.RWMutex
+	policyNames   = make(map[string]struct{})
+)
+
+// RegisterPolicy は Validate が受け付ける Policy の名前を追加する
+// policy パッケージが組み込みの Policy と policy.Register で登録した Policy について呼ぶ
+func RegisterPolicy(name string) {
+	policyNamesMu.Lock()
+	defer policyNamesMu.Unlock()
+	policyNames[name] = struct{}{}
+}
+
+// PolicyNames は登録されている Policy の名前を返す
+func PolicyNames() []string {
+	policyNamesMu.RLock()
+	defer policyNamesMu.RUnlock()
+	var names []string
+	for name := range policyNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// oneOf は value が names のいずれかであるかどうかを返す
+func oneOf(value string, names []string) bool {
+	for _, name := range names {
+		if value == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (strategy DepotStrategy) valid() bool {
+	for _, s := range depotStrategies {
+		if strategy == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (strategy LoadStrategy) valid() bool {
+	for _, s := range loadStrategies {
+		if strategy == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate は各項目が取りうる範囲にあるかどうかを確かめ、問題を全て並べたエラーを返す
+func (config *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	check(config.Policy == "" || oneOf(config.Policy, PolicyNames()), "policy must be one of %v (got %q)", PolicyNames(), config.Policy)
+	check(config.NumAgents >= 1, "numAgents must be at least 1 (got %d)", config.NumAgents)
+	check(config.LastTurn >= 1, "lastTurn must be at least 1 (got %d)", config.LastTurn)
+	check(0 <= config.NewItemProb && config.NewItemProb <= 1, "newItemProb must be in [0, 1] (got %v)", config.NewItemProb)
+	check(config.NumIters >= 0, "numIters must not be negative (got %d)", config.NumIters)
+	check(config.PlanningTimeMs >= 0, "planningTimeMs must not be negative (got %d)", config.PlanningTimeMs)
+	check(config.NumIters > 0 || config.PlanningTimeMs > 0, "either numIters or planningTimeMs must be positive")
+	check(config.NumWorkers >= 0, "numWorkers must not be negative (got %d)", config.NumWorkers)
+	check(config.VirtualLoss >= 0, "virtualLoss must not be negative (got %d)", config.VirtualLoss)
+	check(config.MaxDepth >= 1, "maxDepth must be at least 1 (got %d)", config.MaxDepth)
+	check(config.ExpandThresh >= 0, "expandThresh must not be negative (got %d)", config.ExpandThresh)
+	check(config.Selection == "" || oneOf(config.Selection, selections), "selection must be one of %v (got %q)", selections, config.Selection)
+	check(config.ExplorationConst >= 0, "explorationConst must not be negative (got %v)", config.ExplorationConst)
+	check(0 < config.DiscountFactor && config.DiscountFactor <= 1, "discountFactor must be in (0, 1] (got %v)", config.DiscountFactor)
+	check(config.DistanceOracle == "" || oneOf(config.DistanceOracle, distanceOracles), "distanceOracle must be one of %v (got %q)", distanceOracles, config.DistanceOracle)
+	check(config.Capacity >= 0, "capacity must not be negative (got %d)", config.Capacity)
+	check(config.BatteryCapacity >= 0, "batteryCapacity must not be negative (got %d)", config.BatteryCapacity)
+	check(config.MoveCost >= 0, "moveCost must not be negative (got %d)", config.MoveCost)
+	check(config.ItemCost >= 0, "itemCost must not be negative (got %d)", config.ItemCost)
+	check(config.ChargeRate >= 0, "chargeRate must not be negative (got %d)", config.ChargeRate)
+	check(config.BatteryBucket >= 0, "batteryBucket must not be negative (got %d)", config.BatteryBucket)
+	// 荷物交換を使わない場合は戦略を省略できる
+	for _, field := range []struct {
+		key      string
+		strategy DepotStrategy
+	}{
+		{"requestStrategy", config.RequestStrategy},
+		{"acceptStrategy", config.AcceptStrategy},
+	} {
+		check(field.strategy.valid() || (field.strategy == "" && !config.EnableExchange),
+			"%s must be one of %v (got %q)", field.key, depotStrategies, field.strategy)
+	}
+	check(config.NominateStrategy.valid() || (config.NominateStrategy == "" && !config.EnableExchange),
+		"nominateStrategy must be one of %v (got %q)", loadStrategies, config.NominateStrategy)
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package fduct
 
 import (
+	"fmt"
 	"math"
 	"math/rand"
 	"sync"
@@ -11,9 +12,46 @@ import (
 	"github.com/Div9851/new-warehouse-sim/mapdata"
 )
 
+// 行動選択の規則 (名前は config.Validate で確かめる)
+const (
+	UCB1      = config.UCB1
+	UCB1Tuned = config.UCB1Tuned
+	PUCT      = config.PUCT // Greedy が選ぶ行動に重みを置いた事前確率を使う
+	EXP3      = config.EXP3 // 同時手番を想定した敵対的バンディットの規則
+)
+
+// PUCT の事前確率のうち、Greedy が選ぶ行動以外にも一様に割り振る割合
+const priorEps = 0.25
+
+// Selector は節点で行動を選ぶ規則とそのパラメータ
+type Selector struct {
+	Rule  string
+	C     float64 // 探索の強さ (EXP3 の場合は一様に探索する確率)
+	Scale float64 // 累積報酬をこの値で割って正規化する
+}
+
+// NewSelector は config から Selector を作る
+// Config.ExplorationConst が未指定の場合は規則ごとの既定値 (Config.Exploration) を使う
+// 正規化には 1 ターンの報酬ではなく累積報酬の上限 (Config.ReturnScale) を使う
+// EXP3 は報酬を [0, 1] に写して使うため、Config.NormalizeReward によらず正規化する
+func NewSelector(config *config.Config) Selector {
+	selector := Selector{
+		Rule:  config.SelectionRule(),
+		C:     config.Exploration(),
+		Scale: 1,
+	}
+	if config.NormalizeReward || selector.Rule == EXP3 {
+		selector.Scale = config.ReturnScale()
+	}
+	return selector
+}
+
 type Node struct {
 	CumReward  []float64
+	SqReward   []float64 // 報酬の二乗和 (UCB1_TUNED で分散の見積もりに使う)
 	SelectCnt  []float64
+	Gain       []float64 // EXP3 の重要度重み付きの累積報酬
+	Prior      []float64 // PUCT の事前確率 (未計算の場合は nil)
 	TotalCnt   float64
 	RolloutCnt int
 }
@@ -21,31 +59,139 @@ type Node struct {
 func NewNode() *Node {
 	return &Node{
 		CumReward:  make([]float64, agentaction.COUNT),
+		SqReward:   make([]float64, agentaction.COUNT),
 		SelectCnt:  make([]float64, agentaction.COUNT),
+		Gain:       make([]float64, agentaction.COUNT),
 		TotalCnt:   0,
 		RolloutCnt: 0,
 	}
 }
 
-func (node *Node) UCB1(action agentaction.Action) float64 {
+func (node *Node) UCB1(action agentaction.Action, c float64, scale float64) float64 {
 	if node.SelectCnt[action] == 0 {
 		return math.Inf(1)
 	}
-	score := node.CumReward[action]/node.SelectCnt[action] + math.Sqrt(2*math.Log(node.TotalCnt)/node.SelectCnt[action])
+	score := node.CumReward[action]/node.SelectCnt[action]/scale + c*math.Sqrt(math.Log(node.TotalCnt)/node.SelectCnt[action])
 	return score
 }
 
-func (node *Node) Select(actions agentaction.Actions) agentaction.Action {
+func (node *Node) UCB1Tuned(action agentaction.Action, c float64, scale float64) float64 {
+	n := node.SelectCnt[action]
+	if n == 0 {
+		return math.Inf(1)
+	}
+	logN := math.Log(node.TotalCnt)
+	mean := node.CumReward[action] / n / scale
+	variance := node.SqReward[action]/n/(scale*scale) - mean*mean + math.Sqrt(2*logN/n)
+	return mean + c*math.Sqrt(logN/n*math.Min(0.25, variance))
+}
+
+func (node *Node) PUCT(action agentaction.Action, c float64, scale float64) float64 {
+	q := 0.0
+	if node.SelectCnt[action] > 0 {
+		q = node.CumReward[action] / node.SelectCnt[action] / scale
+	}
+	// 最初の選択でも事前確率が効くように TotalCnt + 1 を使う
+	return q + c*node.Prior[action]*math.Sqrt(node.TotalCnt+1)/(1+node.SelectCnt[action])
+}
+
+// EXP3Probs は EXP3 で actions の各行動を選ぶ確率を返す
+func (node *Node) EXP3Probs(actions agentaction.Actions, gamma float64) []float64 {
+	k := float64(len(actions))
+	eta := gamma / k
+	maxGain := math.Inf(-1)
+	for _, action := range actions {
+		maxGain = math.Max(maxGain, eta*node.Gain[action])
+	}
+	probs := make([]float64, len(actions))
+	sum := 0.0
+	for i, action := range actions {
+		probs[i] = math.Exp(eta*node.Gain[action] - maxGain)
+		sum += probs[i]
+	}
+	for i := range probs {
+		probs[i] = (1-gamma)*probs[i]/sum + gamma/k
+	}
+	return probs
+}
+
+// Select は selector の規則で行動を選び、その行動を選んだ確率とともに返す
+// 決定的な規則の場合、確率は 1 になる
+func (node *Node) Select(actions agentaction.Actions, selector *Selector, randGen *rand.Rand) (agentaction.Action, float64) {
+	if selector.Rule == EXP3 {
+		probs := node.EXP3Probs(actions, selector.C)
+		r := randGen.Float64()
+		for i, prob := range probs {
+			if r < prob {
+				return actions[i], prob
+			}
+			r -= prob
+		}
+		return actions[len(actions)-1], probs[len(probs)-1]
+	}
 	selected := agentaction.COUNT
 	maxScore := math.Inf(-1)
 	for _, action := range actions {
-		score := node.UCB1(action)
+		var score float64
+		switch selector.Rule {
+		case UCB1Tuned:
+			score = node.UCB1Tuned(action, selector.C, selector.Scale)
+		case PUCT:
+			score = node.PUCT(action, selector.C, selector.Scale)
+		case UCB1:
+			score = node.UCB1(action, selector.C, selector.Scale)
+		default:
+			// config.Validate が知らない規則を拒むので、ここには来ない
+			panic(fmt.Sprintf("unknown selection rule %q", selector.Rule))
+		}
 		if maxScore < score {
 			maxScore = score
 			selected = action
 		}
 	}
-	return selected
+	// スコアが全て NaN の場合
+	if selected == agentaction.COUNT {
+		selected = actions[0]
+	}
+	return selected, 1
+}
+
+// Backup は action を選んで累積報酬 reward を得たことを記録する
+// prob は Select が返した、action を選んだ確率 (Select 以外で選んだ場合は 0 とし、EXP3 の重みを更新しない)
+func (node *Node) Backup(action agentaction.Action, reward float64, prob float64, selector *Selector) {
+	node.TotalCnt++
+	node.SelectCnt[action]++
+	node.CumReward[action] += reward
+	node.SqReward[action] += reward * reward
+	if selector.Rule == EXP3 && prob > 0 {
+		x := math.Max(0, math.Min(1, (reward/selector.Scale+1)/2))
+		node.Gain[action] += x / prob
+	}
+}
+
+// AddVirtualLoss は action を n 回選んで累積報酬 loss を得たことにする
+// 木並列化で、探索中の行動を他のゴルーチンが避けるようにするために使う
+func (node *Node) AddVirtualLoss(action agentaction.Action, n float64, loss float64) {
+	node.TotalCnt += n
+	node.SelectCnt[action] += n
+	node.CumReward[action] += n * loss
+	node.SqReward[action] += n * loss * loss
+}
+
+// RemoveVirtualLoss は AddVirtualLoss を取り消す
+func (node *Node) RemoveVirtualLoss(action agentaction.Action, n float64, loss float64) {
+	node.AddVirtualLoss(action, -n, loss)
+}
+
+// Merge は other の各行動の選択回数と累積報酬を node に足し合わせる
+// ルート並列化で独立に探索した木の結果をまとめるために使う
+func (node *Node) Merge(other *Node) {
+	for i := range node.CumReward {
+		node.CumReward[i] += other.CumReward[i]
+		node.SqReward[i] += other.SqReward[i]
+		node.SelectCnt[i] += other.SelectCnt[i]
+	}
+	node.TotalCnt += other.TotalCnt
 }
 
 func (node *Node) GetBestAction(actions agentaction.Actions) (agentaction.Action, float64) {
@@ -64,8 +210,11 @@ func (node *Node) GetBestAction(actions agentaction.Actions) (agentaction.Action
 func (node *Node) Reset() {
 	for i := range node.CumReward {
 		node.CumReward[i] = 0
+		node.SqReward[i] = 0
 		node.SelectCnt[i] = 0
+		node.Gain[i] = 0
 	}
+	node.Prior = nil
 	node.TotalCnt = 0
 	node.RolloutCnt = 0
 }
@@ -77,6 +226,8 @@ type Planner struct {
 	RandGen     *rand.Rand
 	NodePool    *sync.Pool
 	NewItemProb float64
+	Selector    Selector
+	mu          *sync.Mutex // Share した場合に節点の表と節点を守る
 }
 
 func New(mapData *mapdata.MapData, config *config.Config, randGen *rand.Rand, nodePool *sync.Pool, newItemProb float64) *Planner {
@@ -88,67 +239,199 @@ func New(mapData *mapdata.MapData, config *config.Config, randGen *rand.Rand, no
 		RandGen:     randGen,
 		NodePool:    nodePool,
 		NewItemProb: newItemProb,
+		Selector:    NewSelector(config),
 	}
 }
 
-func GetValidActions(state agentstate.State, items map[mapdata.Pos]int, mapData *mapdata.MapData) agentaction.Actions {
-	actions := make(agentaction.Actions, len(mapData.ValidActions[state.Pos.R][state.Pos.C]))
-	copy(actions, mapData.ValidActions[state.Pos.R][state.Pos.C])
-	if !state.HasItem && items[state.Pos] > 0 {
+// Share は複数のゴルーチンから UpdateWith で同じ木を探索できるようにする (木並列化)
+// 探索中の行動には仮想損失を加え、ゴルーチンどうしが同じ経路を辿りにくくする
+func (planner *Planner) Share() {
+	if planner.mu == nil {
+		planner.mu = &sync.Mutex{}
+	}
+}
+
+func (planner *Planner) lock() {
+	if planner.mu != nil {
+		planner.mu.Lock()
+	}
+}
+
+func (planner *Planner) unlock() {
+	if planner.mu != nil {
+		planner.mu.Unlock()
+	}
+}
+
+func GetValidActions(state agentstate.State, items map[mapdata.Pos]int, mapData *mapdata.MapData, config *config.Config) agentaction.Actions {
+	var actions agentaction.Actions
+	if config.BatteryEnabled() && state.Battery <= 0 {
+		// バッテリーが切れたエージェントは移動できない
+		actions = agentaction.Actions{agentaction.STAY}
+	} else {
+		actions = make(agentaction.Actions, len(mapData.ValidActions[state.Pos.R][state.Pos.C]))
+		copy(actions, mapData.ValidActions[state.Pos.R][state.Pos.C])
+	}
+	if state.NumItems < config.CarryCapacity() && items[state.Pos] > 0 && agentstate.CanPickUp(state.Pos, mapData, config) {
 		actions = append(actions, agentaction.PICKUP)
 	}
-	if state.HasItem && state.Pos == mapData.DepotPos {
+	if state.NumItems > 0 && mapData.IsDepot(state.Pos) {
 		actions = append(actions, agentaction.CLEAR)
 	}
+	if agentstate.CanCharge(state, mapData, config) {
+		actions = append(actions, agentaction.CHARGE)
+	}
 	return actions
 }
 
-func Greedy(id int, states agentstate.States, items []map[mapdata.Pos]int, targetPos []mapdata.Pos, mapData *mapdata.MapData, randGen *rand.Rand) agentaction.Action {
+// needsCharge は充電ステーションに向かうべきかどうかを返す
+// 最寄りの充電ステーションまでの移動に必要な量に、容量の 1/4 の余裕を加えた量を下回ったら向かう
+func needsCharge(state agentstate.State, mapData *mapdata.MapData, config *config.Config) bool {
+	d := mapData.ChargerDist[state.Pos.R][state.Pos.C]
+	if d == -1 {
+		return false
+	}
+	return state.Battery < d*config.MoveBatteryCost(state.NumItems)+config.BatteryCapacity/4
+}
+
+// UpdateTarget は Greedy の目的地を選び直して targetPos[id] に設定する
+// 目的地に向かう代わりにその場で行う行動 (PICKUP, CLEAR, CHARGE) がある場合はそれを返す
+// 目的地がない場合、targetPos[id] は NonePos になる
+func UpdateTarget(id int, states agentstate.States, items []map[mapdata.Pos]int, targetPos []mapdata.Pos, mapData *mapdata.MapData, config *config.Config) (agentaction.Action, bool) {
 	state := states[id]
-	validActions := GetValidActions(state, items[id], mapData)
+	if config.BatteryEnabled() {
+		// 充電ステーションにもアイテムは出現するので、拾えるアイテムがあれば充電より先に拾う
+		// 目的地を消しておき、拾った後は充電が必要な場合だけ留まるようにする
+		if state.NumItems < config.CarryCapacity() && items[id][state.Pos] > 0 && agentstate.CanPickUp(state.Pos, mapData, config) {
+			targetPos[id] = mapdata.NonePos
+			return agentaction.PICKUP, true
+		}
+		// 充電のために立ち寄った充電ステーションでは満充電になるまで留まる
+		if agentstate.CanCharge(state, mapData, config) && (targetPos[id] == state.Pos || needsCharge(state, mapData, config)) {
+			targetPos[id] = state.Pos
+			return agentaction.CHARGE, true
+		}
+		if needsCharge(state, mapData, config) && !mapData.IsCharger(targetPos[id]) {
+			targetPos[id] = mapData.NearestCharger(state.Pos)
+		}
+	}
 	if targetPos[id] == state.Pos {
 		targetPos[id] = mapdata.NonePos
 	}
 	if targetPos[id] == mapdata.NonePos {
-		if state.HasItem {
-			if state.Pos == mapData.DepotPos {
-				return agentaction.CLEAR
-			}
-			targetPos[id] = mapData.DepotPos
-		} else {
-			if items[id][state.Pos] > 0 {
-				return agentaction.PICKUP
+		if state.NumItems > 0 && mapData.IsDepot(state.Pos) {
+			return agentaction.CLEAR, true
+		}
+		// 運べる数に余裕があれば最寄りのアイテムを拾いに行き、なければデポへ向かう
+		// ただし、アイテムを運んでいてデポの方が近い場合は先に降ろしに行く
+		if state.NumItems < config.CarryCapacity() {
+			if items[id][state.Pos] > 0 && agentstate.CanPickUp(state.Pos, mapData, config) {
+				return agentaction.PICKUP, true
 			}
 			d := math.MaxInt
 			for pos, itemNum := range items[id] {
-				if itemNum > 0 && d > mapData.MinDist[state.Pos.R][state.Pos.C][pos.R][pos.C] {
-					d = mapData.MinDist[state.Pos.R][state.Pos.C][pos.R][pos.C]
+				if itemNum <= 0 {
+					continue
+				}
+				// 距離が等しい場合は位置の順で選び、map の反復順によらず同じ目的地にする
+				if dist := mapData.MinDist(state.Pos, pos); d > dist || (d == dist && pos.Less(targetPos[id])) {
+					d = dist
 					targetPos[id] = pos
 				}
 			}
-			// アイテムのある頂点がない場合、ランダムに行動
-			if targetPos[id] == mapdata.NonePos {
-				return validActions[randGen.Intn(len(validActions))]
+			if state.NumItems > 0 && d > mapData.DepotDist[state.Pos.R][state.Pos.C] {
+				targetPos[id] = mapdata.NonePos
 			}
 		}
+		if targetPos[id] == mapdata.NonePos && state.NumItems > 0 {
+			targetPos[id] = mapData.NearestDepot(state.Pos)
+		}
 	}
+	return agentaction.COUNT, false
+}
+
+func Greedy(id int, states agentstate.States, items []map[mapdata.Pos]int, targetPos []mapdata.Pos, mapData *mapdata.MapData, config *config.Config, randGen *rand.Rand) agentaction.Action {
+	state := states[id]
+	validActions := GetValidActions(state, items[id], mapData, config)
+	if action, ok := UpdateTarget(id, states, items, targetPos, mapData, config); ok {
+		return action
+	}
+	// 目的地がない場合、ランダムに行動
+	if targetPos[id] == mapdata.NonePos {
+		return validActions[randGen.Intn(len(validActions))]
+	}
+	optimal := approach(state.Pos, targetPos[id], validActions, mapData)
+	// バッテリーが切れて動けない場合
+	if len(optimal) == 0 {
+		return agentaction.STAY
+	}
+	return optimal[randGen.Intn(len(optimal))]
+}
+
+// approach は validActions のうち、pos から target に近づく行動を返す
+func approach(pos mapdata.Pos, target mapdata.Pos, validActions agentaction.Actions, mapData *mapdata.MapData) agentaction.Actions {
 	optimal := agentaction.Actions{}
 	for _, action := range validActions {
-		nxtPos := mapData.NextPos[state.Pos.R][state.Pos.C][action]
-		if mapData.MinDist[state.Pos.R][state.Pos.C][targetPos[id].R][targetPos[id].C] > mapData.MinDist[nxtPos.R][nxtPos.C][targetPos[id].R][targetPos[id].C] {
+		nxtPos := mapData.NextPos[pos.R][pos.C][action]
+		if mapData.MinDist(pos, target) > mapData.MinDist(nxtPos, target) {
 			optimal = append(optimal, action)
 		}
 	}
-	return optimal[randGen.Intn(len(optimal))]
+	return optimal
+}
+
+// prior は PUCT の事前確率として、Greedy が選びうる行動に重みを置いた分布を返す
+// targetPos は変更しない
+func (planner *Planner) prior(id int, states agentstate.States, items []map[mapdata.Pos]int, targetPos []mapdata.Pos, validActions agentaction.Actions) []float64 {
+	target := make([]mapdata.Pos, len(targetPos))
+	copy(target, targetPos)
+	var greedy agentaction.Actions
+	if action, ok := UpdateTarget(id, states, items, target, planner.MapData, planner.Config); ok {
+		greedy = agentaction.Actions{action}
+	} else if target[id] != mapdata.NonePos {
+		greedy = approach(states[id].Pos, target[id], validActions, planner.MapData)
+	}
+	prior := make([]float64, agentaction.COUNT)
+	eps := priorEps
+	if len(greedy) == 0 {
+		eps = 1
+	}
+	for _, action := range validActions {
+		prior[action] = eps / float64(len(validActions))
+	}
+	for _, action := range greedy {
+		prior[action] += (1 - eps) / float64(len(greedy))
+	}
+	return prior
+}
+
+// Root はエージェント id の現在の状態 curState に対応する根の節点を返す
+func (planner *Planner) Root(id int, curState agentstate.State) *Node {
+	return planner.Nodes[id][0][planner.key(curState)]
+}
+
+// key は state の節点を引くキーを返す
+// バッテリー残量で木が細かく分かれないよう、残量は BatteryBucketSize ごとに切り上げてまとめる (切れた状態の 0 は区別する)
+func (planner *Planner) key(state agentstate.State) agentstate.State {
+	if size := planner.Config.BatteryBucketSize(); state.Battery > 0 && size > 1 {
+		state.Battery = (state.Battery + size - 1) / size * size
+	}
+	return state
 }
 
 func (planner *Planner) GetBestAction(id int, curState agentstate.State, items map[mapdata.Pos]int) (agentaction.Action, float64) {
-	node := planner.Nodes[id][0][curState]
-	validActions := GetValidActions(curState, items, planner.MapData)
+	node := planner.Root(id, curState)
+	validActions := GetValidActions(curState, items, planner.MapData, planner.Config)
 	return node.GetBestAction(validActions)
 }
 
 func (planner *Planner) Update(turn int, curStates agentstate.States, items []map[mapdata.Pos]int, iterIdx int) {
+	planner.UpdateWith(planner.RandGen, turn, curStates, items, iterIdx)
+}
+
+// UpdateWith は乱数生成器 randGen を使って 1 回探索する
+// Share した Planner では、ゴルーチンごとに別の randGen を渡して並行に呼び出してよい
+func (planner *Planner) UpdateWith(randGen *rand.Rand, turn int, curStates agentstate.States, items []map[mapdata.Pos]int, iterIdx int) {
 	rollout := make([]bool, planner.Config.NumAgents)
 	targetPos := make([]mapdata.Pos, planner.Config.NumAgents)
 	itemsCopy := make([]map[mapdata.Pos]int, planner.Config.NumAgents)
@@ -159,10 +442,10 @@ func (planner *Planner) Update(turn int, curStates agentstate.States, items []ma
 			itemsCopy[i][pos] = itemNum
 		}
 	}
-	planner.update(turn, 0, curStates, itemsCopy, rollout, targetPos, iterIdx)
+	planner.update(randGen, turn, 0, curStates, itemsCopy, rollout, targetPos, iterIdx)
 }
 
-func (planner *Planner) update(turn int, depth int, curStates agentstate.States, items []map[mapdata.Pos]int, rollout []bool, targetPos []mapdata.Pos, iterIdx int) []float64 {
+func (planner *Planner) update(randGen *rand.Rand, turn int, depth int, curStates agentstate.States, items []map[mapdata.Pos]int, rollout []bool, targetPos []mapdata.Pos, iterIdx int) []float64 {
 	if turn == planner.Config.LastTurn || depth == planner.Config.MaxDepth {
 		return make([]float64, planner.Config.NumAgents)
 	}
@@ -170,16 +453,23 @@ func (planner *Planner) update(turn int, depth int, curStates agentstate.States,
 	nxtRollout := make([]bool, planner.Config.NumAgents)
 	copy(nxtRollout, rollout)
 	nodes := make([]*Node, planner.Config.NumAgents)
+	probs := make([]float64, planner.Config.NumAgents)
+	// 仮想損失は、最悪の場合の累積報酬を得たことにする
+	virtual := make([]bool, planner.Config.NumAgents)
+	virtualLosses := float64(planner.Config.VirtualLosses())
+	virtualLoss := -planner.Config.ReturnScale()
+	planner.lock()
 	for i, state := range curStates {
 		if !rollout[i] {
 			if len(planner.Nodes[i]) <= depth {
 				planner.Nodes[i] = append(planner.Nodes[i], make(map[agentstate.State]*Node))
 			}
-			if node, exist := planner.Nodes[i][depth][state]; exist {
+			key := planner.key(state)
+			if node, exist := planner.Nodes[i][depth][key]; exist {
 				nodes[i] = node
 			} else {
 				nodes[i] = planner.NodePool.Get().(*Node)
-				planner.Nodes[i][depth][state] = nodes[i]
+				planner.Nodes[i][depth][key] = nodes[i]
 			}
 			if nodes[i].RolloutCnt < planner.Config.ExpandThresh {
 				nodes[i].RolloutCnt++
@@ -187,23 +477,34 @@ func (planner *Planner) update(turn int, depth int, curStates agentstate.States,
 			}
 		}
 		if nxtRollout[i] {
-			actions[i] = Greedy(i, curStates, items, targetPos, planner.MapData, planner.RandGen)
+			actions[i] = Greedy(i, curStates, items, targetPos, planner.MapData, planner.Config, randGen)
 		} else {
-			// UCB アルゴリズムに従って行動選択
-			validActions := GetValidActions(state, items[i], planner.MapData)
-			actions[i] = nodes[i].Select(validActions)
+			// Selector の規則に従って行動選択
+			validActions := GetValidActions(state, items[i], planner.MapData, planner.Config)
+			if planner.Selector.Rule == PUCT && nodes[i].Prior == nil {
+				nodes[i].Prior = planner.prior(i, curStates, items, targetPos, validActions)
+			}
+			actions[i], probs[i] = nodes[i].Select(validActions, &planner.Selector, randGen)
+			if planner.mu != nil {
+				nodes[i].AddVirtualLoss(actions[i], virtualLosses, virtualLoss)
+				virtual[i] = true
+			}
 		}
 	}
-	nxtStates, rewards, _ := agentstate.Next(curStates, actions, nxtRollout, items, planner.MapData, planner.Config, planner.RandGen, planner.NewItemProb)
-	cumRewards := planner.update(turn+1, depth+1, nxtStates, items, nxtRollout, targetPos, iterIdx)
+	planner.unlock()
+	nxtStates, rewards, _, _ := agentstate.Next(curStates, actions, nxtRollout, items, planner.MapData, planner.Config, randGen, planner.NewItemProb)
+	cumRewards := planner.update(randGen, turn+1, depth+1, nxtStates, items, nxtRollout, targetPos, iterIdx)
+	planner.lock()
 	for i := range curStates {
 		cumRewards[i] = rewards[i] + planner.Config.DiscountFactor*cumRewards[i]
+		if virtual[i] {
+			nodes[i].RemoveVirtualLoss(actions[i], virtualLosses, virtualLoss)
+		}
 		if !rollout[i] {
-			nodes[i].TotalCnt++
-			nodes[i].SelectCnt[actions[i]]++
-			nodes[i].CumReward[actions[i]] += cumRewards[i]
+			nodes[i].Backup(actions[i], cumRewards[i], probs[i], &planner.Selector)
 		}
 	}
+	planner.unlock()
 	return cumRewards
 }
 
@@ -215,5 +516,40 @@ func (planner *Planner) Free() {
 				planner.NodePool.Put(node)
 			}
 		}
+		planner.Nodes[i] = nil
+	}
+}
+
+// Advance は実際に 1 ターン進んだ後の状態 curStates に合わせて探索木を再利用できるようにする
+// 深さ 0 の表を捨てて深さを 1 つずらし、curStates から到達できない状態の節点を取り除く
+func (planner *Planner) Advance(curStates agentstate.States) {
+	for i := range planner.Nodes {
+		if len(planner.Nodes[i]) == 0 {
+			continue
+		}
+		for _, node := range planner.Nodes[i][0] {
+			node.Reset()
+			planner.NodePool.Put(node)
+		}
+		planner.Nodes[i] = planner.Nodes[i][1:]
+		for depth, table := range planner.Nodes[i] {
+			for state, node := range table {
+				if !planner.reachable(curStates[i], state, depth) {
+					delete(table, state)
+					node.Reset()
+					planner.NodePool.Put(node)
+				}
+			}
+		}
+	}
+}
+
+// reachable は from から depth ターンで to に到達しうるかどうかを返す
+func (planner *Planner) reachable(from agentstate.State, to agentstate.State, depth int) bool {
+	if depth == 0 {
+		return planner.key(from) == to
 	}
+	d := planner.MapData.MinDist(from.Pos, to.Pos)
+	// アイテムは 1 ターンに 1 個しか拾えない
+	return d != -1 && d <= depth && to.NumItems <= from.NumItems+depth
 }
@@ -0,0 +1,51 @@
+package fduct
+
+import (
+	"testing"
+
+	"github.com/Div9851/new-warehouse-sim/agentaction"
+	"github.com/Div9851/new-warehouse-sim/config"
+)
+
+// 1 ターンの報酬の上限を超える累積報酬でも、EXP3 の重みが報酬の大小を区別することを確かめる
+func TestEXP3GainDistinguishesReturns(t *testing.T) {
+	c := config.Default()
+	c.Selection = EXP3
+	selector := NewSelector(&c)
+	node := NewNode()
+	// 荷物を拾ってすぐに届けた場合と、その次のターンにもう 1 つ届けた場合
+	low := c.Reward
+	high := c.Reward + c.DiscountFactor*c.Reward
+	node.Backup(agentaction.UP, low, 0.5, &selector)
+	node.Backup(agentaction.DOWN, high, 0.5, &selector)
+	if node.Gain[agentaction.UP] >= node.Gain[agentaction.DOWN] {
+		t.Errorf("gain of return %v is %v, want less than gain %v of return %v",
+			low, node.Gain[agentaction.UP], node.Gain[agentaction.DOWN], high)
+	}
+}
+
+// 仮想損失を取り消すと、節点の統計が加える前に戻ることを確かめる
+func TestVirtualLossRoundTrip(t *testing.T) {
+	c := config.Default()
+	selector := NewSelector(&c)
+	node := NewNode()
+	node.Backup(agentaction.UP, 50, 1, &selector)
+	want := *node
+	wantCum := append([]float64{}, node.CumReward...)
+	wantSq := append([]float64{}, node.SqReward...)
+	wantCnt := append([]float64{}, node.SelectCnt...)
+	loss := -c.ReturnScale()
+	node.AddVirtualLoss(agentaction.UP, 2, loss)
+	if action, _ := node.Select(agentaction.Actions{agentaction.UP, agentaction.DOWN}, &selector, nil); action != agentaction.DOWN {
+		t.Errorf("selected %s under virtual loss, want DOWN", action.ToStr())
+	}
+	node.RemoveVirtualLoss(agentaction.UP, 2, loss)
+	for a := range wantCum {
+		if node.CumReward[a] != wantCum[a] || node.SqReward[a] != wantSq[a] || node.SelectCnt[a] != wantCnt[a] {
+			t.Errorf("action %d: got (%v, %v, %v), want (%v, %v, %v)", a, node.CumReward[a], node.SqReward[a], node.SelectCnt[a], wantCum[a], wantSq[a], wantCnt[a])
+		}
+	}
+	if node.TotalCnt != want.TotalCnt {
+		t.Errorf("total count %v, want %v", node.TotalCnt, want.TotalCnt)
+	}
+}
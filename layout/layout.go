@@ -0,0 +1,153 @@
+package layout
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/Div9851/new-warehouse-sim/mapdata"
+)
+
+// デポの配置
+const (
+	DepotTop    = "TOP"
+	DepotBottom = "BOTTOM"
+	DepotLeft   = "LEFT"
+	DepotRight  = "RIGHT"
+	DepotRandom = "RANDOM" // 外周の通路からランダムに選ぶ
+)
+
+// Params は倉庫のレイアウトを決めるパラメータ
+//
+// 棚ブロック (BlockHeight x BlockWidth の棚) を BlockRows x BlockCols 個並べる
+// 横に並ぶブロックの間と外周には幅 AisleWidth の通路を置く
+// 縦に並ぶブロックは隙間なく連なり、CrossAisleSpacing 行ごとに幅 AisleWidth の横断通路を置く
+// (CrossAisleSpacing が 0 の場合は外周以外に横断通路を置かない)
+type Params struct {
+	BlockRows         int    `json:"blockRows"`
+	BlockCols         int    `json:"blockCols"`
+	BlockWidth        int    `json:"blockWidth"`
+	BlockHeight       int    `json:"blockHeight"`
+	AisleWidth        int    `json:"aisleWidth"`
+	CrossAisleSpacing int    `json:"crossAisleSpacing"`
+	NumDepots         int    `json:"numDepots"`
+	DepotPlacement    string `json:"depotPlacement"`
+	Seed              int64  `json:"seed"`
+}
+
+func (params *Params) validate() error {
+	switch {
+	case params.BlockRows <= 0 || params.BlockCols <= 0:
+		return fmt.Errorf("number of blocks must be positive")
+	case params.BlockWidth <= 0 || params.BlockHeight <= 0:
+		return fmt.Errorf("block size must be positive")
+	case params.AisleWidth <= 0:
+		return fmt.Errorf("aisle width must be positive")
+	case params.CrossAisleSpacing < 0:
+		return fmt.Errorf("cross-aisle spacing must not be negative")
+	case params.NumDepots <= 0:
+		return fmt.Errorf("number of depots must be positive")
+	}
+	switch params.DepotPlacement {
+	case DepotTop, DepotBottom, DepotLeft, DepotRight, DepotRandom:
+	default:
+		return fmt.Errorf("unknown depot placement `%s`", params.DepotPlacement)
+	}
+	return nil
+}
+
+// Generate は params に従ってマップのテキストを生成する
+func Generate(params *Params) ([]string, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	// 各ブロック行の先頭の行番号
+	blockTop := make([]int, params.BlockRows)
+	h := params.AisleWidth
+	for i := 0; i < params.BlockRows; i++ {
+		if i > 0 && params.CrossAisleSpacing > 0 && i%params.CrossAisleSpacing == 0 {
+			h += params.AisleWidth
+		}
+		blockTop[i] = h
+		h += params.BlockHeight
+	}
+	h += params.AisleWidth
+	w := params.AisleWidth + params.BlockCols*(params.BlockWidth+params.AisleWidth)
+
+	rows := make([][]byte, h)
+	for r := range rows {
+		rows[r] = make([]byte, w)
+		for c := range rows[r] {
+			rows[r][c] = '.'
+		}
+	}
+	for i := 0; i < params.BlockRows; i++ {
+		for j := 0; j < params.BlockCols; j++ {
+			left := params.AisleWidth + j*(params.BlockWidth+params.AisleWidth)
+			for r := blockTop[i]; r < blockTop[i]+params.BlockHeight; r++ {
+				for c := left; c < left+params.BlockWidth; c++ {
+					rows[r][c] = mapdata.Shelf
+				}
+			}
+		}
+	}
+
+	depots, err := depotPositions(params, h, w)
+	if err != nil {
+		return nil, err
+	}
+	for _, pos := range depots {
+		rows[pos.R][pos.C] = mapdata.Depot
+	}
+
+	text := make([]string, h)
+	for r, row := range rows {
+		text[r] = string(row)
+	}
+	return text, nil
+}
+
+// depotPositions はデポを外周の通路上に置く
+// 辺を指定した場合は等間隔に、RANDOM の場合は外周の通路のセルからランダムに選ぶ
+func depotPositions(params *Params, h int, w int) ([]mapdata.Pos, error) {
+	var edge []mapdata.Pos
+	switch params.DepotPlacement {
+	case DepotTop, DepotBottom:
+		r := 0
+		if params.DepotPlacement == DepotBottom {
+			r = h - 1
+		}
+		for c := 0; c < w; c++ {
+			edge = append(edge, mapdata.Pos{R: r, C: c})
+		}
+	case DepotLeft, DepotRight:
+		c := 0
+		if params.DepotPlacement == DepotRight {
+			c = w - 1
+		}
+		for r := 0; r < h; r++ {
+			edge = append(edge, mapdata.Pos{R: r, C: c})
+		}
+	case DepotRandom:
+		for c := 0; c < w; c++ {
+			edge = append(edge, mapdata.Pos{R: 0, C: c}, mapdata.Pos{R: h - 1, C: c})
+		}
+		for r := 1; r < h-1; r++ {
+			edge = append(edge, mapdata.Pos{R: r, C: 0}, mapdata.Pos{R: r, C: w - 1})
+		}
+	}
+	if params.NumDepots > len(edge) {
+		return nil, fmt.Errorf("can't place %d depots on an edge of %d cells", params.NumDepots, len(edge))
+	}
+	var depots []mapdata.Pos
+	if params.DepotPlacement == DepotRandom {
+		randGen := rand.New(rand.NewSource(params.Seed))
+		for _, i := range randGen.Perm(len(edge))[:params.NumDepots] {
+			depots = append(depots, edge[i])
+		}
+		return depots, nil
+	}
+	for i := 0; i < params.NumDepots; i++ {
+		depots = append(depots, edge[(2*i+1)*len(edge)/(2*params.NumDepots)])
+	}
+	return depots, nil
+}
@@ -5,40 +5,127 @@ import (
 )
 
 type Pos struct {
-	R, C int
+	R int `json:"r"`
+	C int `json:"c"`
 }
 
 var NonePos Pos = Pos{R: -1, C: -1}
 
+// Less は pos が other より行優先の順で前にあるかどうかを返す
+// map の反復順に依存しないように、同点の候補から 1 つを選ぶときに使う
+func (pos Pos) Less(other Pos) bool {
+	if pos.R != other.R {
+		return pos.R < other.R
+	}
+	return pos.C < other.C
+}
+
+// マップのセル
+const (
+	Wall    = '#'
+	Depot   = 'D'
+	Shelf   = 'S' // 棚 (通行不可)
+	Charger = 'C' // 充電ステーション
+)
+
+func isBlocked(cell byte) bool {
+	return cell == Wall || cell == Shelf
+}
+
+type move struct {
+	action   agentaction.Action
+	dr, dc   int
+	oneWay   byte // この方向への移動のみを許す一方通行のセル
+	opposite byte // この方向からは進入できない一方通行のセル
+}
+
+var moves = []move{
+	{action: agentaction.UP, dr: -1, dc: 0, oneWay: '^', opposite: 'v'},
+	{action: agentaction.DOWN, dr: 1, dc: 0, oneWay: 'v', opposite: '^'},
+	{action: agentaction.LEFT, dr: 0, dc: -1, oneWay: '<', opposite: '>'},
+	{action: agentaction.RIGHT, dr: 0, dc: 1, oneWay: '>', opposite: '<'},
+}
+
+func isOneWay(cell byte) bool {
+	return cell == '^' || cell == 'v' || cell == '<' || cell == '>'
+}
+
+// canMove は pos から move の方向に移動できるかどうかを返す
+// 一方通行のセルからは矢印の方向にしか移動できず、矢印と逆向きに進入することもできない
+func canMove(text []string, h int, w int, pos Pos, move move) bool {
+	cur := text[pos.R][pos.C]
+	if isOneWay(cur) && cur != move.oneWay {
+		return false
+	}
+	nr, nc := pos.R+move.dr, pos.C+move.dc
+	if 0 > nr || nr >= h || 0 > nc || nc >= w {
+		return false
+	}
+	nxt := text[nr][nc]
+	return !isBlocked(nxt) && nxt != move.opposite
+}
+
 type MapData struct {
-	Text         []string
-	H, W         int
-	AllPos       []Pos
-	DepotPos     Pos
-	NextPos      [][][]Pos
-	ValidActions [][]agentaction.Actions
-	MinDist      [][][][]int
-	SubGoals     map[Pos]struct{}
+	Text             []string
+	H, W             int
+	AllPos           []Pos
+	DepotPositions   map[Pos]struct{}
+	ShelfPositions   map[Pos]struct{}
+	PickPos          []Pos // 棚に隣接する (デポ以外の) セル
+	ChargerPositions map[Pos]struct{}
+	NextPos          [][][]Pos
+	ValidActions     [][]agentaction.Actions
+	CellID           [][]int // 通行可能なセルに振った通し番号 (通行不可の場合は -1)
+	Cells            []Pos   // CellID からセルの位置への対応
+	Oracle           DistanceOracle
+	DepotDist        [][]int // 最寄りのデポまでの距離
+	ChargerDist      [][]int // 最寄りの充電ステーションまでの距離 (充電ステーションがない場合は -1)
+	SubGoals         map[Pos]struct{}
+	nearestDepot     [][]Pos
+	nearestCharger   [][]Pos
+	succ, pred       [][]int32 // CellID で表した有向グラフ
 }
 
+// New は text からマップを構築する
+// 不正なマップに対しては panic するため、入力を検証する場合は Parse を使う
 func New(text []string) *MapData {
+	mapData, err := Parse(text)
+	if err != nil {
+		panic(err)
+	}
+	return mapData
+}
+
+func build(text []string) *MapData {
 	h, w := len(text), len(text[0])
 	var allPos []Pos
-	var depotPos Pos
+	var cells []Pos
+	depotPositions := make(map[Pos]struct{})
+	shelfPositions := make(map[Pos]struct{})
+	chargerPositions := make(map[Pos]struct{})
 	nextPos := make([][][]Pos, h)
 	validActions := make([][]agentaction.Actions, h)
-	minDist := make([][][][]int, h)
+	cellID := make([][]int, h)
 	subGoals := make(map[Pos]struct{})
 	for r := 0; r < h; r++ {
 		nextPos[r] = make([][]Pos, w)
 		validActions[r] = make([]agentaction.Actions, w)
-		minDist[r] = make([][][]int, w)
+		cellID[r] = make([]int, w)
 		for c := 0; c < w; c++ {
-			if text[r][c] == '#' {
+			cellID[r][c] = -1
+			if text[r][c] == Shelf {
+				shelfPositions[Pos{r, c}] = struct{}{}
+			}
+			if isBlocked(text[r][c]) {
 				continue
 			}
-			if text[r][c] == 'D' {
-				depotPos = Pos{r, c}
+			cellID[r][c] = len(cells)
+			cells = append(cells, Pos{r, c})
+			if text[r][c] == Charger {
+				chargerPositions[Pos{r, c}] = struct{}{}
+			}
+			if text[r][c] == Depot {
+				depotPositions[Pos{r, c}] = struct{}{}
 			} else {
 				allPos = append(allPos, Pos{r, c})
 			}
@@ -46,25 +133,15 @@ func New(text []string) *MapData {
 			nextPos[r][c][agentaction.STAY] = Pos{R: r, C: c}
 			nextPos[r][c][agentaction.PICKUP] = Pos{R: r, C: c}
 			nextPos[r][c][agentaction.CLEAR] = Pos{R: r, C: c}
+			nextPos[r][c][agentaction.CHARGE] = Pos{R: r, C: c}
 			actions := agentaction.Actions{agentaction.STAY}
-			if r > 0 && text[r-1][c] != '#' {
-				nextPos[r][c][agentaction.UP] = Pos{R: r - 1, C: c}
-				actions = append(actions, agentaction.UP)
-			}
-			if r+1 < h && text[r+1][c] != '#' {
-				nextPos[r][c][agentaction.DOWN] = Pos{R: r + 1, C: c}
-				actions = append(actions, agentaction.DOWN)
-			}
-			if c > 0 && text[r][c-1] != '#' {
-				nextPos[r][c][agentaction.LEFT] = Pos{R: r, C: c - 1}
-				actions = append(actions, agentaction.LEFT)
-			}
-			if c+1 < w && text[r][c+1] != '#' {
-				nextPos[r][c][agentaction.RIGHT] = Pos{R: r, C: c + 1}
-				actions = append(actions, agentaction.RIGHT)
+			for _, move := range moves {
+				if canMove(text, h, w, Pos{R: r, C: c}, move) {
+					nextPos[r][c][move.action] = Pos{R: r + move.dr, C: c + move.dc}
+					actions = append(actions, move.action)
+				}
 			}
 			validActions[r][c] = actions
-			minDist[r][c] = bfs(text, h, w, Pos{R: r, C: c})
 			// 交差点をサブゴールとする
 			if len(actions) >= 4 {
 				subGoals[Pos{R: r, C: c}] = struct{}{}
@@ -72,46 +149,152 @@ func New(text []string) *MapData {
 		}
 	}
 
-	return &MapData{
-		Text:         text,
-		H:            h,
-		W:            w,
-		AllPos:       allPos,
-		DepotPos:     depotPos,
-		NextPos:      nextPos,
-		ValidActions: validActions,
-		MinDist:      minDist,
-		SubGoals:     subGoals,
+	// 一方通行のセルがあるため、グラフは有向グラフとして持つ
+	succ := make([][]int32, len(cells))
+	pred := make([][]int32, len(cells))
+	for id, pos := range cells {
+		for _, action := range validActions[pos.R][pos.C] {
+			nxt := nextPos[pos.R][pos.C][action]
+			if nxt == pos {
+				continue
+			}
+			nxtID := cellID[nxt.R][nxt.C]
+			succ[id] = append(succ[id], int32(nxtID))
+			pred[nxtID] = append(pred[nxtID], int32(id))
+		}
 	}
+
+	var pickPos []Pos
+	for _, pos := range allPos {
+		if isNextToShelf(text, h, w, pos) {
+			pickPos = append(pickPos, pos)
+		}
+	}
+
+	mapData := &MapData{
+		Text:             text,
+		H:                h,
+		W:                w,
+		AllPos:           allPos,
+		DepotPositions:   depotPositions,
+		ShelfPositions:   shelfPositions,
+		PickPos:          pickPos,
+		ChargerPositions: chargerPositions,
+		NextPos:          nextPos,
+		ValidActions:     validActions,
+		CellID:           cellID,
+		Cells:            cells,
+		SubGoals:         subGoals,
+		succ:             succ,
+		pred:             pred,
+	}
+
+	mapData.DepotDist, mapData.nearestDepot = mapData.nearest(Depot)
+	mapData.ChargerDist, mapData.nearestCharger = mapData.nearest(Charger)
+	mapData.Oracle = NewLazyOracle(mapData)
+	return mapData
+}
+
+// MinDist は from から to への最短距離を返す (到達できない場合は -1)
+func (mapData *MapData) MinDist(from Pos, to Pos) int {
+	return mapData.Oracle.Dist(from, to)
+}
+
+func (mapData *MapData) IsDepot(pos Pos) bool {
+	_, ok := mapData.DepotPositions[pos]
+	return ok
 }
 
-func bfs(text []string, h int, w int, startPos Pos) [][]int {
+// IsPickPos は pos が棚に隣接するセルかどうかを返す
+func (mapData *MapData) IsPickPos(pos Pos) bool {
+	return !isBlocked(mapData.Text[pos.R][pos.C]) && !mapData.IsDepot(pos) && isNextToShelf(mapData.Text, mapData.H, mapData.W, pos)
+}
+
+func isNextToShelf(text []string, h int, w int, pos Pos) bool {
 	dr := []int{-1, 0, 1, 0}
 	dc := []int{0, 1, 0, -1}
-	minDist := [][]int{}
-	for i := 0; i < h; i++ {
-		minDist = append(minDist, make([]int, w))
-		for j := 0; j < w; j++ {
-			minDist[i][j] = -1
+	for i := 0; i < 4; i++ {
+		nr, nc := pos.R+dr[i], pos.C+dc[i]
+		if 0 <= nr && nr < h && 0 <= nc && nc < w && text[nr][nc] == Shelf {
+			return true
 		}
 	}
-	minDist[startPos.R][startPos.C] = 0
-	que := []Pos{startPos}
-	for len(que) > 0 {
-		cur := que[0]
-		r, c := cur.R, cur.C
-		que = que[1:]
-		for i := 0; i < 4; i++ {
-			nr, nc := r+dr[i], c+dc[i]
-			nxt := Pos{R: nr, C: nc}
-			if 0 > nr || nr >= h || 0 > nc || nc >= w || text[nr][nc] == '#' {
-				continue
+	return false
+}
+
+// NearestDepot は pos から最も近いデポの位置を返す
+func (mapData *MapData) NearestDepot(pos Pos) Pos {
+	return mapData.nearestDepot[pos.R][pos.C]
+}
+
+func (mapData *MapData) IsCharger(pos Pos) bool {
+	_, ok := mapData.ChargerPositions[pos]
+	return ok
+}
+
+// NearestCharger は pos から最も近い充電ステーションの位置を返す (ない場合は NonePos)
+func (mapData *MapData) NearestCharger(pos Pos) Pos {
+	return mapData.nearestCharger[pos.R][pos.C]
+}
+
+// nearest は cell の文字を持つ全セルを始点として逆向きに BFS し、各セルから最も近いそのセルまでの距離と位置を求める
+// 始点は行優先で並べるため、距離が等しい場合の選択は決定的になる
+func (mapData *MapData) nearest(cell byte) ([][]int, [][]Pos) {
+	var sources []int
+	for id, pos := range mapData.Cells {
+		if mapData.Text[pos.R][pos.C] == cell {
+			sources = append(sources, id)
+		}
+	}
+	dist, origin := mapData.bfs(sources, true)
+	nearestDist := make([][]int, mapData.H)
+	nearestPos := make([][]Pos, mapData.H)
+	for r := 0; r < mapData.H; r++ {
+		nearestDist[r] = make([]int, mapData.W)
+		nearestPos[r] = make([]Pos, mapData.W)
+		for c := 0; c < mapData.W; c++ {
+			nearestDist[r][c] = -1
+			nearestPos[r][c] = NonePos
+			if id := mapData.CellID[r][c]; id != -1 && dist[id] != -1 {
+				nearestDist[r][c] = int(dist[id])
+				nearestPos[r][c] = mapData.Cells[origin[id]]
 			}
-			if minDist[nr][nc] == -1 {
-				minDist[nr][nc] = minDist[r][c] + 1
+		}
+	}
+	return nearestDist, nearestPos
+}
+
+// bfs は sources からの各セルへの最短距離と、最も近い始点の CellID を返す
+// reverse が true の場合は辺を逆向きにたどり、各セルから sources への距離を求める
+func (mapData *MapData) bfs(sources []int, reverse bool) ([]int32, []int32) {
+	graph := mapData.succ
+	if reverse {
+		graph = mapData.pred
+	}
+	n := len(mapData.Cells)
+	dist := make([]int32, n)
+	origin := make([]int32, n)
+	for i := range dist {
+		dist[i] = -1
+		origin[i] = -1
+	}
+	que := make([]int32, 0, n)
+	for _, src := range sources {
+		if dist[src] == -1 {
+			dist[src] = 0
+			origin[src] = int32(src)
+			que = append(que, int32(src))
+		}
+	}
+	for head := 0; head < len(que); head++ {
+		cur := que[head]
+		for _, nxt := range graph[cur] {
+			if dist[nxt] == -1 {
+				dist[nxt] = dist[cur] + 1
+				origin[nxt] = origin[cur]
 				que = append(que, nxt)
 			}
 		}
 	}
-	return minDist
+	return dist, origin
 }
@@ -0,0 +1,184 @@
+package mapdata
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Overlay は MovingAI のベンチマーク形式にないデポと棚の位置を指定する
+type Overlay struct {
+	Depots  []Pos `json:"depots"`
+	Shelves []Pos `json:"shelves"`
+}
+
+// ReadMovingAI は MovingAI のベンチマーク形式 (.map) を読み込み、このパッケージの形式のテキストに変換する
+// '.', 'G', 'S' は通行可能なセル、'@', 'O', 'T', 'W' は壁とする
+func ReadMovingAI(r io.Reader) ([]string, error) {
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	nextLine := func() (string, bool) {
+		if !scanner.Scan() {
+			return "", false
+		}
+		lineNo++
+		return strings.TrimRight(scanner.Text(), "\r"), true
+	}
+	h, w := -1, -1
+	for {
+		line, ok := nextLine()
+		if !ok {
+			if scanner.Err() != nil {
+				return nil, scanner.Err()
+			}
+			return nil, &ParseError{Msg: "missing `map` line"}
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "map" {
+			break
+		}
+		if len(fields) != 2 {
+			return nil, &ParseError{Line: lineNo, Msg: fmt.Sprintf("malformed header %q", line)}
+		}
+		switch fields[0] {
+		case "type":
+			if fields[1] != "octile" {
+				return nil, &ParseError{Line: lineNo, Msg: fmt.Sprintf("unsupported map type %q", fields[1])}
+			}
+		case "height", "width":
+			v, err := strconv.Atoi(fields[1])
+			if err != nil || v <= 0 {
+				return nil, &ParseError{Line: lineNo, Msg: fmt.Sprintf("invalid %s %q", fields[0], fields[1])}
+			}
+			if fields[0] == "height" {
+				h = v
+			} else {
+				w = v
+			}
+		default:
+			return nil, &ParseError{Line: lineNo, Msg: fmt.Sprintf("unknown header %q", fields[0])}
+		}
+	}
+	if h == -1 || w == -1 {
+		return nil, &ParseError{Line: lineNo, Msg: "`height` and `width` must be given before `map`"}
+	}
+	text := make([]string, 0, h)
+	for len(text) < h {
+		line, ok := nextLine()
+		if !ok {
+			if scanner.Err() != nil {
+				return nil, scanner.Err()
+			}
+			return nil, &ParseError{Line: lineNo, Msg: fmt.Sprintf("map has %d rows, expected %d", len(text), h)}
+		}
+		if len(line) != w {
+			return nil, &ParseError{Line: lineNo, Msg: fmt.Sprintf("row has length %d, expected %d", len(line), w)}
+		}
+		row := make([]byte, w)
+		for c := 0; c < w; c++ {
+			switch line[c] {
+			case '.', 'G', 'S':
+				row[c] = '.'
+			case '@', 'O', 'T', 'W':
+				row[c] = Wall
+			default:
+				return nil, &ParseError{Line: lineNo, Col: c + 1, Msg: fmt.Sprintf("unknown cell %q", line[c])}
+			}
+		}
+		text = append(text, string(row))
+	}
+	return text, nil
+}
+
+// ParseMovingAI は MovingAI のベンチマーク形式のマップに overlay のデポと棚を置いてマップを構築する
+// pruneUnreachable が true の場合、デポから到達できないセルを壁に変える
+// (ベンチマークのマップは連結でないことが多いため)
+func ParseMovingAI(r io.Reader, overlay *Overlay, pruneUnreachable bool) (*MapData, error) {
+	text, err := ReadMovingAI(r)
+	if err != nil {
+		return nil, err
+	}
+	text, err = overlay.Apply(text)
+	if err != nil {
+		return nil, err
+	}
+	if pruneUnreachable {
+		text = pruneUnreachableCells(text)
+	}
+	return Parse(text)
+}
+
+// Apply は text にデポと棚を書き込んだ新しいテキストを返す
+func (overlay *Overlay) Apply(text []string) ([]string, error) {
+	rows := make([][]byte, len(text))
+	for r, line := range text {
+		rows[r] = []byte(line)
+	}
+	inside := func(pos Pos) bool {
+		return 0 <= pos.R && pos.R < len(rows) && 0 <= pos.C && pos.C < len(rows[pos.R])
+	}
+	for _, pos := range overlay.Shelves {
+		if !inside(pos) {
+			return nil, fmt.Errorf("shelf %v is out of the map", pos)
+		}
+		rows[pos.R][pos.C] = Shelf
+	}
+	for _, pos := range overlay.Depots {
+		if !inside(pos) {
+			return nil, fmt.Errorf("depot %v is out of the map", pos)
+		}
+		if isBlocked(rows[pos.R][pos.C]) {
+			return nil, fmt.Errorf("depot %v is placed on a blocked cell", pos)
+		}
+		rows[pos.R][pos.C] = Depot
+	}
+	res := make([]string, len(rows))
+	for r, row := range rows {
+		res[r] = string(row)
+	}
+	return res, nil
+}
+
+// pruneUnreachableCells はデポと 4 近傍でつながっていない通行可能なセルを壁に変える
+// 一方通行のセルを含まないテキストを前提とする
+func pruneUnreachableCells(text []string) []string {
+	h := len(text)
+	visited := make([][]bool, h)
+	var que []Pos
+	for r := 0; r < h; r++ {
+		visited[r] = make([]bool, len(text[r]))
+		for c := 0; c < len(text[r]); c++ {
+			if text[r][c] == Depot {
+				visited[r][c] = true
+				que = append(que, Pos{R: r, C: c})
+			}
+		}
+	}
+	for head := 0; head < len(que); head++ {
+		cur := que[head]
+		for _, move := range moves {
+			nr, nc := cur.R+move.dr, cur.C+move.dc
+			if 0 > nr || nr >= h || 0 > nc || nc >= len(text[nr]) || visited[nr][nc] || isBlocked(text[nr][nc]) {
+				continue
+			}
+			visited[nr][nc] = true
+			que = append(que, Pos{R: nr, C: nc})
+		}
+	}
+	res := make([]string, h)
+	for r := 0; r < h; r++ {
+		row := []byte(text[r])
+		for c := range row {
+			if !visited[r][c] && !isBlocked(row[c]) {
+				row[c] = Wall
+			}
+		}
+		res[r] = string(row)
+	}
+	return res
+}
@@ -0,0 +1,283 @@
+package mapdata
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Div9851/new-warehouse-sim/config"
+)
+
+// DistanceOracle は 2 セル間の最短距離を返す
+// 到達できない場合は -1 を返す
+type DistanceOracle interface {
+	Dist(from Pos, to Pos) int
+}
+
+const (
+	DenseOracleKind    = config.DenseOracle
+	LazyOracleKind     = config.LazyOracle
+	LandmarkOracleKind = config.LandmarkOracle
+
+	DefaultNumLandmarks = 8
+	// LandmarkOracle が A* で求めた距離を覚えておく数 (2 の冪)
+	DefaultLandmarkCacheSize = 1 << 16
+)
+
+// NewOracle は kind に対応する DistanceOracle を構築する
+// kind が空の場合は LAZY とする
+func NewOracle(kind string, mapData *MapData) (DistanceOracle, error) {
+	switch kind {
+	case "", LazyOracleKind:
+		return NewLazyOracle(mapData), nil
+	case DenseOracleKind:
+		return NewDenseOracle(mapData), nil
+	case LandmarkOracleKind:
+		return NewLandmarkOracle(mapData, DefaultNumLandmarks, DefaultLandmarkCacheSize), nil
+	}
+	return nil, fmt.Errorf("unknown distance oracle %q", kind)
+}
+
+// DenseOracle は全セル間の距離を CellID で引ける表として持つ
+// 距離が int16 に収まる場合は int16、そうでなければ int32 で格納する
+type DenseOracle struct {
+	mapData *MapData
+	n       int
+	dist16  []int16
+	dist32  []int32
+}
+
+func NewDenseOracle(mapData *MapData) *DenseOracle {
+	n := len(mapData.Cells)
+	oracle := &DenseOracle{
+		mapData: mapData,
+		n:       n,
+	}
+	// 最短距離は高々 n-1 なので、n で格納する型を決める
+	if n <= math.MaxInt16 {
+		oracle.dist16 = make([]int16, n*n)
+	} else {
+		oracle.dist32 = make([]int32, n*n)
+	}
+	for from := 0; from < n; from++ {
+		dist, _ := mapData.bfs([]int{from}, false)
+		for to, d := range dist {
+			if oracle.dist16 != nil {
+				oracle.dist16[from*n+to] = int16(d)
+			} else {
+				oracle.dist32[from*n+to] = d
+			}
+		}
+	}
+	return oracle
+}
+
+func (oracle *DenseOracle) Dist(from Pos, to Pos) int {
+	i, j := oracle.mapData.CellID[from.R][from.C], oracle.mapData.CellID[to.R][to.C]
+	if oracle.dist16 != nil {
+		return int(oracle.dist16[i*oracle.n+j])
+	}
+	return int(oracle.dist32[i*oracle.n+j])
+}
+
+// LazyOracle は問い合わせのあった目的地ごとに逆向きの BFS を行い、結果をキャッシュする
+// 複数の goroutine から同時に呼び出してよい
+type LazyOracle struct {
+	mapData *MapData
+	cache   []atomic.Value // [目的地の CellID] => []int32
+	mu      sync.Mutex
+}
+
+func NewLazyOracle(mapData *MapData) *LazyOracle {
+	return &LazyOracle{
+		mapData: mapData,
+		cache:   make([]atomic.Value, len(mapData.Cells)),
+	}
+}
+
+func (oracle *LazyOracle) Dist(from Pos, to Pos) int {
+	dist := oracle.distTo(oracle.mapData.CellID[to.R][to.C])
+	return int(dist[oracle.mapData.CellID[from.R][from.C]])
+}
+
+func (oracle *LazyOracle) distTo(target int) []int32 {
+	if dist, ok := oracle.cache[target].Load().([]int32); ok {
+		return dist
+	}
+	oracle.mu.Lock()
+	defer oracle.mu.Unlock()
+	if dist, ok := oracle.cache[target].Load().([]int32); ok {
+		return dist
+	}
+	dist, _ := oracle.mapData.bfs([]int{target}, true)
+	oracle.cache[target].Store(dist)
+	return dist
+}
+
+// LandmarkOracle は少数のランドマークとの距離だけを持ち、三角不等式から距離の上下界を求める
+// Dist は下界をヒューリスティックとした A* 探索で正確な距離を求め、結果を固定の大きさの表にキャッシュする
+// 使うメモリはセル数 n に対して 8 * ランドマーク数 * n バイトと、キャッシュの 12 * cacheSize バイトで、
+// DenseOracle の 2〜4 * n^2 バイトと違い、大きなマップでもセル数に比例する分しか増えない
+type LandmarkOracle struct {
+	mapData   *MapData
+	fromLand  [][]int32 // [ランドマーク][CellID] => ランドマークからの距離
+	toLand    [][]int32 // [ランドマーク][CellID] => ランドマークへの距離
+	cacheMu   sync.Mutex
+	cache     []landmarkEntry // (from, to) のハッシュで位置を決め、衝突した場合は上書きする
+	Landmarks []Pos
+}
+
+// landmarkEntry は LandmarkOracle のキャッシュの 1 つの項目 (空の場合は from が -1)
+type landmarkEntry struct {
+	from, to, dist int32
+}
+
+// NewLandmarkOracle は numLandmarks 個のランドマークを選び、A* の結果を cacheSize 個まで覚える LandmarkOracle を構築する
+// cacheSize は 2 の冪に切り上げる (0 の場合はキャッシュしない)
+func NewLandmarkOracle(mapData *MapData, numLandmarks int, cacheSize int) *LandmarkOracle {
+	oracle := &LandmarkOracle{
+		mapData: mapData,
+	}
+	if cacheSize > 0 {
+		size := 1
+		for size < cacheSize {
+			size *= 2
+		}
+		oracle.cache = make([]landmarkEntry, size)
+		for i := range oracle.cache {
+			oracle.cache[i].from = -1
+		}
+	}
+	n := len(mapData.Cells)
+	if numLandmarks > n {
+		numLandmarks = n
+	}
+	// 既存のランドマークから最も遠いセルを順に選ぶ
+	minDist := make([]int32, n)
+	for i := range minDist {
+		minDist[i] = math.MaxInt32
+	}
+	next := 0
+	for k := 0; k < numLandmarks; k++ {
+		fromLand, _ := mapData.bfs([]int{next}, false)
+		toLand, _ := mapData.bfs([]int{next}, true)
+		oracle.fromLand = append(oracle.fromLand, fromLand)
+		oracle.toLand = append(oracle.toLand, toLand)
+		oracle.Landmarks = append(oracle.Landmarks, mapData.Cells[next])
+		for id, d := range fromLand {
+			if d != -1 && d < minDist[id] {
+				minDist[id] = d
+			}
+		}
+		for id, d := range minDist {
+			if d > minDist[next] {
+				next = id
+			}
+		}
+	}
+	return oracle
+}
+
+// Bounds は from から to への距離の下界と上界を返す
+func (oracle *LandmarkOracle) Bounds(from Pos, to Pos) (int, int) {
+	i, j := oracle.mapData.CellID[from.R][from.C], oracle.mapData.CellID[to.R][to.C]
+	return oracle.lowerBound(i, j), oracle.upperBound(i, j)
+}
+
+func (oracle *LandmarkOracle) lowerBound(i int, j int) int {
+	lo := 0
+	for k := range oracle.fromLand {
+		// d(L, j) <= d(L, i) + d(i, j), d(i, L) <= d(i, j) + d(j, L)
+		if a, b := oracle.fromLand[k][j], oracle.fromLand[k][i]; a != -1 && b != -1 && int(a-b) > lo {
+			lo = int(a - b)
+		}
+		if a, b := oracle.toLand[k][i], oracle.toLand[k][j]; a != -1 && b != -1 && int(a-b) > lo {
+			lo = int(a - b)
+		}
+	}
+	return lo
+}
+
+func (oracle *LandmarkOracle) upperBound(i int, j int) int {
+	hi := -1
+	for k := range oracle.fromLand {
+		a, b := oracle.toLand[k][i], oracle.fromLand[k][j]
+		if a != -1 && b != -1 && (hi == -1 || int(a+b) < hi) {
+			hi = int(a + b)
+		}
+	}
+	return hi
+}
+
+func (oracle *LandmarkOracle) Dist(from Pos, to Pos) int {
+	i, j := oracle.mapData.CellID[from.R][from.C], oracle.mapData.CellID[to.R][to.C]
+	if i == j {
+		return 0
+	}
+	if len(oracle.cache) == 0 {
+		return oracle.astar(i, j)
+	}
+	slot := &oracle.cache[oracle.slot(i, j)]
+	oracle.cacheMu.Lock()
+	entry := *slot
+	oracle.cacheMu.Unlock()
+	if entry.from == int32(i) && entry.to == int32(j) {
+		return int(entry.dist)
+	}
+	d := oracle.astar(i, j)
+	oracle.cacheMu.Lock()
+	*slot = landmarkEntry{from: int32(i), to: int32(j), dist: int32(d)}
+	oracle.cacheMu.Unlock()
+	return d
+}
+
+// slot は (from, to) の組を置くキャッシュの位置を返す
+func (oracle *LandmarkOracle) slot(from int, to int) int {
+	h := (uint64(from)<<32 | uint64(uint32(to))) * 0x9e3779b97f4a7c15
+	return int(h>>32) & (len(oracle.cache) - 1)
+}
+
+func (oracle *LandmarkOracle) astar(src int, dst int) int {
+	if oracle.upperBound(src, dst) == -1 {
+		return -1
+	}
+	g := make(map[int32]int32)
+	g[int32(src)] = 0
+	que := &astarQueue{{id: int32(src), f: int32(oracle.lowerBound(src, dst))}}
+	for que.Len() > 0 {
+		cur := heap.Pop(que).(astarItem)
+		if int(cur.id) == dst {
+			return int(g[cur.id])
+		}
+		if cur.f-int32(oracle.lowerBound(int(cur.id), dst)) > g[cur.id] {
+			continue
+		}
+		for _, nxt := range oracle.mapData.succ[cur.id] {
+			ng := g[cur.id] + 1
+			if d, ok := g[nxt]; !ok || ng < d {
+				g[nxt] = ng
+				heap.Push(que, astarItem{id: nxt, f: ng + int32(oracle.lowerBound(int(nxt), dst))})
+			}
+		}
+	}
+	return -1
+}
+
+type astarItem struct {
+	id, f int32
+}
+
+type astarQueue []astarItem
+
+func (que astarQueue) Len() int            { return len(que) }
+func (que astarQueue) Less(i, j int) bool  { return que[i].f < que[j].f }
+func (que astarQueue) Swap(i, j int)       { que[i], que[j] = que[j], que[i] }
+func (que *astarQueue) Push(x interface{}) { *que = append(*que, x.(astarItem)) }
+func (que *astarQueue) Pop() interface{} {
+	old := *que
+	item := old[len(old)-1]
+	*que = old[:len(old)-1]
+	return item
+}
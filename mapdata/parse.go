@@ -0,0 +1,100 @@
+package mapdata
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseError はマップの不正箇所を表す
+// Line, Col は 1 始まりで、0 の場合はその位置情報を持たない
+type ParseError struct {
+	Line, Col int
+	Msg       string
+}
+
+func (err *ParseError) Error() string {
+	switch {
+	case err.Line == 0:
+		return err.Msg
+	case err.Col == 0:
+		return fmt.Sprintf("line %d: %s", err.Line, err.Msg)
+	default:
+		return fmt.Sprintf("line %d, column %d: %s", err.Line, err.Col, err.Msg)
+	}
+}
+
+func isValidCell(cell byte) bool {
+	return cell == '.' || cell == Depot || cell == Charger || isBlocked(cell) || isOneWay(cell)
+}
+
+// IsCell は c がマップのテキストのセルに使われる文字かどうかを返す
+func IsCell(c byte) bool {
+	return isValidCell(c)
+}
+
+// Parse は text を検証してマップを構築する
+// 行の長さが揃っていること、未知の文字を含まないこと、デポが存在すること、
+// 通行可能なセルが互いに到達可能であることを確かめる
+func Parse(text []string) (*MapData, error) {
+	// 末尾の空行は無視する
+	for len(text) > 0 && strings.TrimRight(text[len(text)-1], "\r") == "" {
+		text = text[:len(text)-1]
+	}
+	if len(text) == 0 {
+		return nil, &ParseError{Msg: "map is empty"}
+	}
+	lines := make([]string, len(text))
+	for i, line := range text {
+		lines[i] = strings.TrimRight(line, "\r")
+	}
+	w := len(lines[0])
+	if w == 0 {
+		return nil, &ParseError{Line: 1, Msg: "row is empty"}
+	}
+	hasDepot := false
+	for r, line := range lines {
+		if len(line) != w {
+			return nil, &ParseError{Line: r + 1, Msg: fmt.Sprintf("row has length %d, expected %d", len(line), w)}
+		}
+		for c := 0; c < w; c++ {
+			if !isValidCell(line[c]) {
+				return nil, &ParseError{Line: r + 1, Col: c + 1, Msg: fmt.Sprintf("unknown cell %q", line[c])}
+			}
+			if line[c] == Depot {
+				hasDepot = true
+			}
+		}
+	}
+	if !hasDepot {
+		return nil, &ParseError{Msg: fmt.Sprintf("map has no depot (%q)", Depot)}
+	}
+	mapData := build(lines)
+	if err := mapData.checkConnected(); err != nil {
+		return nil, err
+	}
+	return mapData, nil
+}
+
+// checkConnected は通行可能なセルが互いに到達可能であることを確かめる
+func (mapData *MapData) checkConnected() error {
+	// 行優先で最初のデポを基準にする
+	originID := -1
+	for id, pos := range mapData.Cells {
+		if mapData.Text[pos.R][pos.C] == Depot {
+			originID = id
+			break
+		}
+	}
+	origin := mapData.Cells[originID]
+	from, _ := mapData.bfs([]int{originID}, false)
+	to, _ := mapData.bfs([]int{originID}, true)
+	for id, pos := range mapData.Cells {
+		if from[id] == -1 {
+			return &ParseError{Line: pos.R + 1, Col: pos.C + 1, Msg: fmt.Sprintf("cell is unreachable from the depot at line %d, column %d", origin.R+1, origin.C+1)}
+		}
+		if to[id] == -1 {
+			return &ParseError{Line: pos.R + 1, Col: pos.C + 1, Msg: fmt.Sprintf("cell can't reach the depot at line %d, column %d", origin.R+1, origin.C+1)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package policy
+
+import (
+	"math/rand"
+
+	"github.com/Div9851/new-warehouse-sim/agentaction"
+	"github.com/Div9851/new-warehouse-sim/agentstate"
+	"github.com/Div9851/new-warehouse-sim/config"
+	"github.com/Div9851/new-warehouse-sim/fduct"
+	"github.com/Div9851/new-warehouse-sim/mapdata"
+)
+
+// GreedyPolicy は fduct のロールアウトと同じ貪欲法で行動を決める
+// 目的地はターンをまたいで保持する
+type GreedyPolicy struct {
+	MapData   *mapdata.MapData
+	Config    *config.Config
+	RandGens  []*rand.Rand
+	TargetPos []mapdata.Pos
+}
+
+func NewGreedy(mapData *mapdata.MapData, config *config.Config, randGens []*rand.Rand) Policy {
+	targetPos := make([]mapdata.Pos, config.NumAgents)
+	for i := range targetPos {
+		targetPos[i] = mapdata.NonePos
+	}
+	return &GreedyPolicy{
+		MapData:   mapData,
+		Config:    config,
+		RandGens:  randGens,
+		TargetPos: targetPos,
+	}
+}
+
+func (policy *GreedyPolicy) Decide(turn int, id int, states agentstate.States, items []map[mapdata.Pos]int) agentaction.Action {
+	// Greedy は targetPos[id] しか書き換えないため、エージェントごとに並行に呼び出してよい
+	return fduct.Greedy(id, states, items, policy.TargetPos, policy.MapData, policy.Config, policy.RandGens[id])
+}
+
+// 他のエージェントがいるセルに入れずに待ったターンがこの回数続いたエージェントは、相手の ID が小さければ道を譲る
+const greedyYieldAfter = 2
+
+// 道を譲るエージェントが相手から離れ続けるターン数
+const greedyYieldTurns = 3
+
+// GreedyYieldPolicy は GreedyPolicy と同じ目的地に向かいつつ、衝突を避ける
+// 他のエージェントがいるセルには入らずに待ち、通路で向かい合って待ち続ける場合は ID の大きい方が相手から離れて道を譲る
+// 同じセルに入ろうとして衝突した場合も、次のターンは ID の大きい方が待つ
+// 道を譲る移動で乱数を使うため、同じシードでも GreedyPolicy とは異なる乱数列になる
+type GreedyYieldPolicy struct {
+	MapData    *mapdata.MapData
+	Config     *config.Config
+	RandGens   []*rand.Rand
+	TargetPos  []mapdata.Pos
+	lastPos    []mapdata.Pos
+	lastAction agentaction.Actions
+	waiting    []int         // 他のエージェントがいるセルに入れずに待ったターンが続いた回数
+	yielding   []int         // 道を譲るために残り何ターン離れ続けるか
+	yieldFrom  []mapdata.Pos // 道を譲る相手の位置
+}
+
+func NewGreedyYield(mapData *mapdata.MapData, config *config.Config, randGens []*rand.Rand) Policy {
+	targetPos := make([]mapdata.Pos, config.NumAgents)
+	lastPos := make([]mapdata.Pos, config.NumAgents)
+	for i := range targetPos {
+		targetPos[i] = mapdata.NonePos
+		lastPos[i] = mapdata.NonePos
+	}
+	return &GreedyYieldPolicy{
+		MapData:    mapData,
+		Config:     config,
+		RandGens:   randGens,
+		TargetPos:  targetPos,
+		lastPos:    lastPos,
+		lastAction: make(agentaction.Actions, config.NumAgents),
+		waiting:    make([]int, config.NumAgents),
+		yielding:   make([]int, config.NumAgents),
+		yieldFrom:  make([]mapdata.Pos, config.NumAgents),
+	}
+}
+
+func (policy *GreedyYieldPolicy) Decide(turn int, id int, states agentstate.States, items []map[mapdata.Pos]int) agentaction.Action {
+	// Greedy も道を譲るための状態もエージェント id の分しか書き換えないため、エージェントごとに並行に呼び出してよい
+	action := policy.decide(id, states, items)
+	policy.lastPos[id] = states[id].Pos
+	policy.lastAction[id] = action
+	return action
+}
+
+func (policy *GreedyYieldPolicy) decide(id int, states agentstate.States, items []map[mapdata.Pos]int) agentaction.Action {
+	state := states[id]
+	nextPos := policy.MapData.NextPos[state.Pos.R][state.Pos.C]
+	// 前のターンに移動しようとして動けなかった
+	collided := policy.lastPos[id] == state.Pos && nextPos[policy.lastAction[id]] != state.Pos
+	action := fduct.Greedy(id, states, items, policy.TargetPos, policy.MapData, policy.Config, policy.RandGens[id])
+	if policy.yielding[id] > 0 {
+		policy.yielding[id]--
+		if away := policy.away(id, states, policy.yieldFrom[id]); len(away) > 0 {
+			return away[policy.RandGens[id].Intn(len(away))]
+		}
+	}
+	nxt := nextPos[action]
+	if nxt == state.Pos {
+		policy.waiting[id] = 0
+		return action
+	}
+	blocker := -1
+	for other := range states {
+		if other == id {
+			continue
+		}
+		if states[other].Pos == nxt {
+			blocker = other
+		}
+		// ID の小さいエージェントも同じセルに入ろうとしている可能性がある場合は待つ
+		if collided && other < id && policy.canEnter(states[other].Pos, nxt) {
+			policy.waiting[id] = 0
+			return agentaction.STAY
+		}
+	}
+	if blocker < 0 {
+		policy.waiting[id] = 0
+		return action
+	}
+	policy.waiting[id]++
+	if policy.waiting[id] >= greedyYieldAfter && blocker < id {
+		policy.waiting[id] = 0
+		policy.yielding[id] = greedyYieldTurns
+		policy.yieldFrom[id] = nxt
+		if away := policy.away(id, states, nxt); len(away) > 0 {
+			policy.yielding[id]--
+			return away[policy.RandGens[id].Intn(len(away))]
+		}
+	}
+	return agentaction.STAY
+}
+
+// canEnter は pos から 1 回の移動で nxt に入れるかどうかを返す
+func (policy *GreedyYieldPolicy) canEnter(pos mapdata.Pos, nxt mapdata.Pos) bool {
+	for _, action := range policy.MapData.ValidActions[pos.R][pos.C] {
+		if policy.MapData.NextPos[pos.R][pos.C][action] == nxt && pos != nxt {
+			return true
+		}
+	}
+	return false
+}
+
+// away はエージェント id が移動する行動のうち、他のエージェントがいないセルに入り、from から最も遠ざかるものを返す
+// バッテリーが切れて動けない場合は空を返す
+func (policy *GreedyYieldPolicy) away(id int, states agentstate.States, from mapdata.Pos) agentaction.Actions {
+	state := states[id]
+	if policy.Config.BatteryEnabled() && state.Battery <= 0 {
+		return nil
+	}
+	occupied := make(map[mapdata.Pos]struct{})
+	for _, other := range states {
+		occupied[other.Pos] = struct{}{}
+	}
+	pos := state.Pos
+	var best agentaction.Actions
+	bestDist := -1
+	for _, action := range policy.MapData.ValidActions[pos.R][pos.C] {
+		nxt := policy.MapData.NextPos[pos.R][pos.C][action]
+		if _, ok := occupied[nxt]; ok || nxt == from {
+			continue
+		}
+		if d := policy.MapData.MinDist(from, nxt); d > bestDist {
+			best, bestDist = agentaction.Actions{action}, d
+		} else if d == bestDist {
+			best = append(best, action)
+		}
+	}
+	return best
+}
+
+// RandomPolicy は可能な行動から一様ランダムに選ぶ
+type RandomPolicy struct {
+	MapData  *mapdata.MapData
+	Config   *config.Config
+	RandGens []*rand.Rand
+}
+
+func NewRandom(mapData *mapdata.MapData, config *config.Config, randGens []*rand.Rand) Policy {
+	return &RandomPolicy{
+		MapData:  mapData,
+		Config:   config,
+		RandGens: randGens,
+	}
+}
+
+func (policy *RandomPolicy) Decide(turn int, id int, states agentstate.States, items []map[mapdata.Pos]int) agentaction.Action {
+	validActions := fduct.GetValidActions(states[id], items[id], policy.MapData, policy.Config)
+	return validActions[policy.RandGens[id].Intn(len(validActions))]
+}
@@ -0,0 +1,178 @@
+package policy
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Div9851/new-warehouse-sim/agentaction"
+	"github.com/Div9851/new-warehouse-sim/agentstate"
+	"github.com/Div9851/new-warehouse-sim/config"
+	"github.com/Div9851/new-warehouse-sim/fduct"
+	"github.com/Div9851/new-warehouse-sim/mapdata"
+)
+
+// FDUCTPolicy はエージェントごとに fduct.Planner で探索して行動を決める
+//
+// Config.PlanningTimeMs が正の場合は、1 ターンあたりその時間だけ探索を繰り返す
+// (Config.NumIters が正の場合は反復回数の上限としても使う)
+// そうでない場合は Config.NumIters 回だけ探索し、結果は実行環境によらず再現できる
+//
+// Config.ReuseTree が true の場合は、エージェントごとの探索木を次のターンに引き継ぎ、
+// 実際に進んだ状態から到達できない節点だけを捨てる
+//
+// Config.NumWorkers が 2 以上の場合はルート並列化を行う
+// エージェントごとに別々の乱数生成器を持つ独立な木を並行に探索し、根での選択回数の合計で行動を選ぶ
+// 各木は Config.NumIters や Config.PlanningTimeMs の予算をそれぞれ使い切る
+//
+// Config.TreeParallel が true の場合は、代わりに木並列化を行う
+// Config.NumWorkers 個のゴルーチンが仮想損失を加えながらエージェントごとに 1 つの木を探索し、Config.NumIters を分け合う
+// ゴルーチンの実行順に結果が左右されるため、同じシードでも結果は再現できない
+type FDUCTPolicy struct {
+	MapData     *mapdata.MapData
+	Config      *config.Config
+	RandGens    []*rand.Rand
+	NodePool    *sync.Pool
+	lastIters   []int
+	workerRands [][]*rand.Rand     // [id][worker]
+	planners    [][]*fduct.Planner // [id][worker]
+	plannedTurn []int
+}
+
+func NewFDUCT(mapData *mapdata.MapData, config *config.Config, randGens []*rand.Rand) Policy {
+	workerRands := make([][]*rand.Rand, config.NumAgents)
+	planners := make([][]*fduct.Planner, config.NumAgents)
+	for id := range workerRands {
+		// 1 つ目の木はエージェントの乱数生成器をそのまま使う
+		workerRands[id] = []*rand.Rand{randGens[id]}
+		for w := 1; w < config.Workers(); w++ {
+			workerRands[id] = append(workerRands[id], rand.New(rand.NewSource(randGens[id].Int63())))
+		}
+		planners[id] = make([]*fduct.Planner, config.Workers())
+	}
+	return &FDUCTPolicy{
+		MapData:  mapData,
+		Config:   config,
+		RandGens: randGens,
+		NodePool: &sync.Pool{
+			New: func() interface{} {
+				return fduct.NewNode()
+			},
+		},
+		lastIters:   make([]int, config.NumAgents),
+		workerRands: workerRands,
+		planners:    planners,
+		plannedTurn: make([]int, config.NumAgents),
+	}
+}
+
+func (policy *FDUCTPolicy) Decide(turn int, id int, states agentstate.States, items []map[mapdata.Pos]int) agentaction.Action {
+	var planners []*fduct.Planner
+	if policy.Config.TreeParallel {
+		planners = []*fduct.Planner{policy.planner(turn, id, 0, states)}
+		policy.lastIters[id] = policy.searchShared(planners[0], policy.workerRands[id], turn, states, items)
+	} else {
+		planners = make([]*fduct.Planner, policy.Config.Workers())
+		iters := make([]int, len(planners))
+		var wg sync.WaitGroup
+		for w := range planners {
+			planners[w] = policy.planner(turn, id, w, states)
+			wg.Add(1)
+			go func(w int) {
+				iters[w] = policy.search(planners[w], turn, states, items)
+				wg.Done()
+			}(w)
+		}
+		wg.Wait()
+		policy.lastIters[id] = 0
+		for _, n := range iters {
+			policy.lastIters[id] += n
+		}
+	}
+	policy.plannedTurn[id] = turn
+	root := fduct.NewNode()
+	for _, planner := range planners {
+		root.Merge(planner.Root(id, states[id]))
+	}
+	action, _ := root.GetBestAction(fduct.GetValidActions(states[id], items[id], policy.MapData, policy.Config))
+	if !policy.Config.ReuseTree {
+		for _, planner := range planners {
+			planner.Free()
+		}
+	}
+	return action
+}
+
+// planner はエージェント id の w 番目の木の探索にこのターン使う Planner を返す
+// 探索木を再利用する場合、前のターンから続けて呼ばれたときは木を 1 ターン分進める
+func (policy *FDUCTPolicy) planner(turn int, id int, w int, states agentstate.States) *fduct.Planner {
+	randGen := policy.workerRands[id][w]
+	if !policy.Config.ReuseTree {
+		return fduct.New(policy.MapData, policy.Config, randGen, policy.NodePool, 0)
+	}
+	planner := policy.planners[id][w]
+	switch {
+	case planner == nil:
+		planner = fduct.New(policy.MapData, policy.Config, randGen, policy.NodePool, 0)
+		policy.planners[id][w] = planner
+	case policy.plannedTurn[id] == turn-1:
+		planner.Advance(states)
+	case policy.plannedTurn[id] != turn:
+		planner.Free()
+	}
+	return planner
+}
+
+// search は planner で探索を繰り返し、反復回数を返す
+func (policy *FDUCTPolicy) search(planner *fduct.Planner, turn int, states agentstate.States, items []map[mapdata.Pos]int) int {
+	if policy.Config.PlanningTimeMs <= 0 {
+		for iter := 0; iter < policy.Config.NumIters; iter++ {
+			planner.Update(turn, states, items, iter)
+		}
+		return policy.Config.NumIters
+	}
+	deadline := time.Now().Add(time.Duration(policy.Config.PlanningTimeMs) * time.Millisecond)
+	iter := 0
+	// 行動を選べるように、最低 1 回は探索する
+	for iter == 0 || time.Now().Before(deadline) {
+		if policy.Config.NumIters > 0 && iter >= policy.Config.NumIters {
+			break
+		}
+		planner.Update(turn, states, items, iter)
+		iter++
+	}
+	return iter
+}
+
+// searchShared は randGens の数のゴルーチンで planner の 1 つの木を探索し、反復回数の合計を返す
+func (policy *FDUCTPolicy) searchShared(planner *fduct.Planner, randGens []*rand.Rand, turn int, states agentstate.States, items []map[mapdata.Pos]int) int {
+	planner.Share()
+	deadline := time.Now().Add(time.Duration(policy.Config.PlanningTimeMs) * time.Millisecond)
+	var next, done int64
+	var wg sync.WaitGroup
+	for _, randGen := range randGens {
+		wg.Add(1)
+		go func(randGen *rand.Rand) {
+			defer wg.Done()
+			for {
+				iter := int(atomic.AddInt64(&next, 1) - 1)
+				if policy.Config.NumIters > 0 && iter >= policy.Config.NumIters {
+					return
+				}
+				// 行動を選べるように、最低 1 回は探索する
+				if policy.Config.PlanningTimeMs > 0 && iter > 0 && !time.Now().Before(deadline) {
+					return
+				}
+				planner.UpdateWith(randGen, turn, states, items, iter)
+				atomic.AddInt64(&done, 1)
+			}
+		}(randGen)
+	}
+	wg.Wait()
+	return int(done)
+}
+
+func (policy *FDUCTPolicy) LastIterations(id int) int {
+	return policy.lastIters[id]
+}
@@ -0,0 +1,89 @@
+package policy
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/Div9851/new-warehouse-sim/agentaction"
+	"github.com/Div9851/new-warehouse-sim/agentstate"
+	"github.com/Div9851/new-warehouse-sim/config"
+	"github.com/Div9851/new-warehouse-sim/mapdata"
+)
+
+// Policy は各ターンに各エージェントの行動を決める
+// Decide は同じターンの異なるエージェントについて並行に呼び出されうる
+// states と items は読み取り専用として扱うこと
+type Policy interface {
+	Decide(turn int, id int, states agentstate.States, items []map[mapdata.Pos]int) agentaction.Action
+}
+
+// IterationReporter は直前の Decide で行った探索の反復回数を報告する Policy
+type IterationReporter interface {
+	LastIterations(id int) int
+}
+
+// Factory は Policy を構築する
+// randGens[id] はエージェント id の行動決定に使う乱数生成器
+type Factory func(mapData *mapdata.MapData, config *config.Config, randGens []*rand.Rand) Policy
+
+const (
+	FDUCT       = config.DefaultPolicy
+	Greedy      = "GREEDY"
+	GreedyYield = "GREEDY_YIELD"
+	Random      = "RANDOM"
+	Prioritized = "PRIORITIZED"
+)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]Factory{
+		FDUCT:       NewFDUCT,
+		Greedy:      NewGreedy,
+		GreedyYield: NewGreedyYield,
+		Random:      NewRandom,
+		Prioritized: NewPrioritized,
+	}
+)
+
+func init() {
+	for name := range factories {
+		config.RegisterPolicy(name)
+	}
+}
+
+// Register は name で選べる Policy を追加する
+// sim.go を変更せずに独自の Policy を config から選べるようにするために使う
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[name] = factory
+	config.RegisterPolicy(name)
+}
+
+// Names は登録されている Policy の名前を返す
+func Names() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	var names []string
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New は name の Policy を構築する (name が空の場合は FDUCT)
+func New(name string, mapData *mapdata.MapData, config *config.Config, randGens []*rand.Rand) (Policy, error) {
+	if name == "" {
+		name = FDUCT
+	}
+	factoriesMu.RLock()
+	factory, ok := factories[name]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown policy %q (available: %v)", name, Names())
+	}
+	return factory(mapData, config, randGens), nil
+}
@@ -0,0 +1,306 @@
+package policy
+
+import (
+	"container/heap"
+	"math"
+	"math/rand"
+	"sync"
+
+	"github.com/Div9851/new-warehouse-sim/agentaction"
+	"github.com/Div9851/new-warehouse-sim/agentstate"
+	"github.com/Div9851/new-warehouse-sim/config"
+	"github.com/Div9851/new-warehouse-sim/fduct"
+	"github.com/Div9851/new-warehouse-sim/mapdata"
+)
+
+// PrioritizedPolicy は ID の小さいエージェントから順に時空間 A* で経路を計画する
+// 各エージェントは Greedy と同じ目的地に向かい、優先度の高いエージェントの経路を予約表として避ける
+// その場で行動する (PICKUP, CLEAR, CHARGE) エージェントを最も優先し、目的地のないエージェントは最後に計画して道を空けさせる
+// 計画はターンごとに全エージェント分をまとめて行う
+type PrioritizedPolicy struct {
+	MapData   *mapdata.MapData
+	Config    *config.Config
+	RandGens  []*rand.Rand
+	TargetPos []mapdata.Pos
+	mu        sync.Mutex
+	planTurn  int
+	plan      agentaction.Actions
+}
+
+func NewPrioritized(mapData *mapdata.MapData, config *config.Config, randGens []*rand.Rand) Policy {
+	targetPos := make([]mapdata.Pos, config.NumAgents)
+	for i := range targetPos {
+		targetPos[i] = mapdata.NonePos
+	}
+	return &PrioritizedPolicy{
+		MapData:   mapData,
+		Config:    config,
+		RandGens:  randGens,
+		TargetPos: targetPos,
+		planTurn:  -1,
+	}
+}
+
+func (policy *PrioritizedPolicy) Decide(turn int, id int, states agentstate.States, items []map[mapdata.Pos]int) agentaction.Action {
+	policy.mu.Lock()
+	defer policy.mu.Unlock()
+	if policy.planTurn != turn {
+		policy.planAll(turn, states, items)
+		policy.planTurn = turn
+	}
+	return policy.plan[id]
+}
+
+type spaceTime struct {
+	pos mapdata.Pos
+	t   int
+}
+
+type spaceTimeEdge struct {
+	from, to mapdata.Pos
+	t        int
+}
+
+// reservations は計画済みの経路が占める時空間のセルと辺を、予約したエージェントの ID とともに持つ
+type reservations struct {
+	cells   map[spaceTime]int
+	edges   map[spaceTimeEdge]int
+	planned []bool
+}
+
+// blocked は id が cur から nxt に進めないかどうかを返す
+// 計画していないエージェントが最初のステップに留まる予約は、そのエージェントを押し出せるので妨げにならない
+func (res *reservations) blocked(id int, cur spaceTime, nxt spaceTime) bool {
+	if owner, ok := res.cells[nxt]; ok && owner != id && res.planned[owner] {
+		return true
+	}
+	// すれ違いによる衝突
+	if owner, ok := res.edges[spaceTimeEdge{from: nxt.pos, to: cur.pos, t: cur.t}]; ok && owner != id {
+		return true
+	}
+	return false
+}
+
+// reserve は id の経路 path を予約する
+// 経路の終点には計画の終わりまで留まるとして予約する
+func (res *reservations) reserve(id int, path []mapdata.Pos, horizon int) {
+	for t := 1; t <= horizon; t++ {
+		cur := path[len(path)-1]
+		if t < len(path) {
+			cur = path[t]
+			res.edges[spaceTimeEdge{from: path[t-1], to: cur, t: t - 1}] = id
+		}
+		key := spaceTime{pos: cur, t: t}
+		if owner, ok := res.cells[key]; !ok || !res.planned[owner] {
+			res.cells[key] = id
+		}
+	}
+	// 移動に失敗した場合に後続が入ってこないように、今いるセルも最初のステップまで予約する
+	key := spaceTime{pos: path[0], t: 1}
+	if owner, ok := res.cells[key]; !ok || !res.planned[owner] {
+		res.cells[key] = id
+	}
+}
+
+// release は id の予約を取り消す
+func (res *reservations) release(id int) {
+	for key, owner := range res.cells {
+		if owner == id {
+			delete(res.cells, key)
+		}
+	}
+	for key, owner := range res.edges {
+		if owner == id {
+			delete(res.edges, key)
+		}
+	}
+}
+
+func (policy *PrioritizedPolicy) planAll(turn int, states agentstate.States, items []map[mapdata.Pos]int) {
+	horizon := policy.Config.MaxDepth
+	if rest := policy.Config.LastTurn - turn; rest < horizon {
+		horizon = rest
+	}
+	if horizon < 1 {
+		horizon = 1
+	}
+	res := &reservations{
+		cells:   make(map[spaceTime]int),
+		edges:   make(map[spaceTimeEdge]int),
+		planned: make([]bool, len(states)),
+	}
+	// 計画する前の時点では他のエージェントが留まるかどうかわからないので、
+	// 最初のステップでは他のエージェントが今いるセルに入らない (押し出す場合を除く)
+	occupant := make(map[mapdata.Pos]int)
+	for id, state := range states {
+		occupant[state.Pos] = id
+		res.cells[spaceTime{pos: state.Pos, t: 1}] = id
+	}
+	policy.plan = make(agentaction.Actions, len(states))
+	var order, moving, idle []int
+	for id := range states {
+		policy.plan[id] = agentaction.STAY
+		if action, ok := fduct.UpdateTarget(id, states, items, policy.TargetPos, policy.MapData, policy.Config); ok {
+			policy.plan[id] = action
+			order = append(order, id)
+		} else if policy.TargetPos[id] != mapdata.NonePos {
+			moving = append(moving, id)
+		} else {
+			idle = append(idle, id)
+		}
+	}
+	order = append(append(order, moving...), idle...)
+	paths := make([][]mapdata.Pos, len(states))
+	for _, id := range order {
+		if !res.planned[id] {
+			policy.planAgent(id, states, horizon, res, occupant, paths)
+		}
+	}
+}
+
+// planAgent は id の経路を計画して予約する
+// 最初のステップで計画していないエージェントのセルに入る場合は、そのエージェントを続けて計画して押し出す
+// 押し出せなかった場合は、そのエージェントが留まるとして計画し直す
+func (policy *PrioritizedPolicy) planAgent(id int, states agentstate.States, horizon int, res *reservations, occupant map[mapdata.Pos]int, paths [][]mapdata.Pos) {
+	res.planned[id] = true
+	state := states[id]
+	paths[id] = []mapdata.Pos{state.Pos}
+	// その場で行動するエージェントは留まる
+	if policy.plan[id] != agentaction.STAY {
+		res.reserve(id, paths[id], horizon)
+		return
+	}
+	// 目的地のないエージェントは今いるセルの近くに留まる
+	target := policy.TargetPos[id]
+	if target == mapdata.NonePos {
+		target = state.Pos
+	}
+	for {
+		path := policy.search(id, state, target, horizon, res)
+		paths[id] = path
+		res.reserve(id, path, horizon)
+		if len(path) == 1 {
+			policy.plan[id] = agentaction.STAY
+			return
+		}
+		policy.plan[id] = policy.actionTo(state.Pos, path[1])
+		other, ok := occupant[path[1]]
+		if !ok || res.planned[other] {
+			return
+		}
+		policy.planAgent(other, states, horizon, res, occupant, paths)
+		if pushed := paths[other]; len(pushed) > 1 && pushed[1] != pushed[0] {
+			return
+		}
+		res.release(id)
+		res.reserve(other, paths[other], horizon)
+	}
+}
+
+func (policy *PrioritizedPolicy) actionTo(cur mapdata.Pos, nxt mapdata.Pos) agentaction.Action {
+	for _, action := range policy.MapData.ValidActions[cur.R][cur.C] {
+		if policy.MapData.NextPos[cur.R][cur.C][action] == nxt {
+			return action
+		}
+	}
+	return agentaction.STAY
+}
+
+// search は予約を避けながら target に向かう経路を時空間 A* で求める
+// horizon ステップ以内に到達できない場合は、horizon まで予約を避け続けられる経路のうち target に最も近づけるものを返す
+// (道を塞いでいるエージェントは、優先度の高いエージェントの経路から退く)
+func (policy *PrioritizedPolicy) search(id int, state agentstate.State, target mapdata.Pos, horizon int, res *reservations) []mapdata.Pos {
+	mapData := policy.MapData
+	start := spaceTime{pos: state.Pos, t: 0}
+	parent := map[spaceTime]spaceTime{start: start}
+	que := &spaceTimeQueue{{node: start, h: mapData.MinDist(state.Pos, target)}}
+	moveCost := policy.Config.MoveBatteryCost(state.NumItems)
+	// 予約を避け続けられる経路がない場合は、単に target に最も近づける経路を使う
+	best, near := start, start
+	bestH, nearH := math.MaxInt, mapData.MinDist(state.Pos, target)
+	for que.Len() > 0 {
+		cur := heap.Pop(que).(spaceTimeItem)
+		if cur.h < nearH || (cur.h == nearH && cur.node.t < near.t) {
+			near, nearH = cur.node, cur.h
+		}
+		// target に着いても、その後に留まれない場合は探索を続ける
+		if arrived := cur.h == 0 && res.canStay(id, cur.node, horizon); arrived || cur.node.t == horizon {
+			if cur.h < bestH {
+				best, bestH = cur.node, cur.h
+			}
+			if arrived {
+				break
+			}
+			continue
+		}
+		moves := mapData.ValidActions[cur.node.pos.R][cur.node.pos.C]
+		// バッテリーは位置が変わったときだけ減る (agentstate.Next と同じ)
+		if policy.Config.BatteryEnabled() && state.Battery-cur.moves*moveCost <= 0 {
+			moves = agentaction.Actions{agentaction.STAY}
+		}
+		for _, action := range moves {
+			nxt := spaceTime{pos: mapData.NextPos[cur.node.pos.R][cur.node.pos.C][action], t: cur.node.t + 1}
+			if _, ok := parent[nxt]; ok {
+				continue
+			}
+			if res.blocked(id, cur.node, nxt) {
+				continue
+			}
+			parent[nxt] = cur.node
+			moved := cur.moves
+			if nxt.pos != cur.node.pos {
+				moved++
+			}
+			heap.Push(que, spaceTimeItem{node: nxt, h: mapData.MinDist(nxt.pos, target), moves: moved})
+		}
+	}
+	if bestH == math.MaxInt {
+		best = near
+	}
+	var path []mapdata.Pos
+	for cur := best; ; cur = parent[cur] {
+		path = append(path, cur.pos)
+		if cur == start {
+			break
+		}
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+// canStay は id が node の位置に horizon まで留まっても他の予約と重ならないかどうかを返す
+func (res *reservations) canStay(id int, node spaceTime, horizon int) bool {
+	for t := node.t + 1; t <= horizon; t++ {
+		if owner, ok := res.cells[spaceTime{pos: node.pos, t: t}]; ok && owner != id && res.planned[owner] {
+			return false
+		}
+	}
+	return true
+}
+
+type spaceTimeItem struct {
+	node  spaceTime
+	h     int
+	moves int // start から node までに位置が変わった回数
+}
+
+type spaceTimeQueue []spaceTimeItem
+
+func (que spaceTimeQueue) Len() int { return len(que) }
+func (que spaceTimeQueue) Less(i, j int) bool {
+	fi, fj := que[i].node.t+que[i].h, que[j].node.t+que[j].h
+	if fi != fj {
+		return fi < fj
+	}
+	return que[i].h < que[j].h
+}
+func (que spaceTimeQueue) Swap(i, j int)       { que[i], que[j] = que[j], que[i] }
+func (que *spaceTimeQueue) Push(x interface{}) { *que = append(*que, x.(spaceTimeItem)) }
+func (que *spaceTimeQueue) Pop() interface{} {
+	old := *que
+	item := old[len(old)-1]
+	*que = old[:len(old)-1]
+	return item
+}
@@ -0,0 +1,100 @@
+package sim
+
+import (
+	"sort"
+
+	"github.com/Div9851/new-warehouse-sim/agentaction"
+	"github.com/Div9851/new-warehouse-sim/agentstate"
+	"github.com/Div9851/new-warehouse-sim/mapdata"
+)
+
+// Metrics は 1 回の実行について集計する指標
+// 同じ位置にある同じエージェントのアイテムは区別できないので、古いものから順に拾われたとみなす
+type Metrics struct {
+	SpawnToPickup     []int // 拾われたアイテムごとの、出現してから拾われるまでのターン数
+	PickupToClear     []int // 降ろされたアイテムごとの、拾われてからデポで降ろされるまでのターン数
+	Collisions        []int // エージェントごとの衝突したターン数
+	StayTurns         []int // エージェントごとの STAY を選んだターン数
+	IdleTurns         []int // エージェントごとの、移動もアイテムの受け渡しも充電もしなかったターン数
+	Distance          []int // エージェントごとの移動したマスの数
+	ExchangedItems    int   // 荷物交換で担当が移ったアイテムの数
+	ExchangeDistSaved int   // 荷物交換によって担当するエージェントからアイテムまでの距離が短くなった量の合計
+
+	spawnTurns  []map[mapdata.Pos][]int // [id][pos] 担当するアイテムが出現したターン (昇順)
+	pickupTurns [][]int                 // [id] 運んでいるアイテムを拾ったターン
+}
+
+func NewMetrics(numAgents int) *Metrics {
+	metrics := &Metrics{
+		Collisions:  make([]int, numAgents),
+		StayTurns:   make([]int, numAgents),
+		IdleTurns:   make([]int, numAgents),
+		Distance:    make([]int, numAgents),
+		spawnTurns:  make([]map[mapdata.Pos][]int, numAgents),
+		pickupTurns: make([][]int, numAgents),
+	}
+	for i := range metrics.spawnTurns {
+		metrics.spawnTurns[i] = make(map[mapdata.Pos][]int)
+	}
+	return metrics
+}
+
+// observeExchanges は荷物交換の直前の states から見た exchanges を集計する
+func (metrics *Metrics) observeExchanges(exchanges []Exchange, states agentstate.States, mapData *mapdata.MapData) {
+	for _, exchange := range exchanges {
+		metrics.ExchangedItems++
+		metrics.ExchangeDistSaved += mapData.MinDist(states[exchange.From].Pos, exchange.Pos) - mapData.MinDist(states[exchange.To].Pos, exchange.Pos)
+		// 最も古いアイテムの担当が移ったとみなす
+		from := metrics.spawnTurns[exchange.From][exchange.Pos]
+		if len(from) == 0 {
+			continue
+		}
+		turn := from[0]
+		metrics.spawnTurns[exchange.From][exchange.Pos] = from[1:]
+		to := append(metrics.spawnTurns[exchange.To][exchange.Pos], turn)
+		sort.Ints(to)
+		metrics.spawnTurns[exchange.To][exchange.Pos] = to
+	}
+}
+
+// observeTurn は turn に actions を行って curStates が nxtStates になったことを集計する
+func (metrics *Metrics) observeTurn(turn int, curStates agentstate.States, nxtStates agentstate.States, actions agentaction.Actions, spawns []mapdata.Pos, collisions []bool) {
+	for i := range curStates {
+		cur, nxt := curStates[i], nxtStates[i]
+		moved := cur.Pos != nxt.Pos
+		acted := false
+		if collisions[i] {
+			metrics.Collisions[i]++
+		}
+		if actions[i] == agentaction.STAY {
+			metrics.StayTurns[i]++
+		}
+		if moved {
+			metrics.Distance[i]++
+		}
+		if nxt.NumItems > cur.NumItems {
+			acted = true
+			metrics.pickupTurns[i] = append(metrics.pickupTurns[i], turn)
+			if spawned := metrics.spawnTurns[i][cur.Pos]; len(spawned) > 0 {
+				metrics.SpawnToPickup = append(metrics.SpawnToPickup, turn-spawned[0])
+				metrics.spawnTurns[i][cur.Pos] = spawned[1:]
+			}
+		}
+		if actions[i] == agentaction.CLEAR && nxt.NumItems < cur.NumItems {
+			acted = true
+			for _, pickedUp := range metrics.pickupTurns[i] {
+				metrics.PickupToClear = append(metrics.PickupToClear, turn-pickedUp)
+			}
+			metrics.pickupTurns[i] = metrics.pickupTurns[i][:0]
+		}
+		if actions[i] == agentaction.CHARGE && nxt.Battery > cur.Battery {
+			acted = true
+		}
+		if !moved && !acted {
+			metrics.IdleTurns[i]++
+		}
+		if spawns[i] != mapdata.NonePos {
+			metrics.spawnTurns[i][spawns[i]] = append(metrics.spawnTurns[i][spawns[i]], turn)
+		}
+	}
+}
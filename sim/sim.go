@@ -2,6 +2,7 @@ package sim
 
 import (
 	"fmt"
+	"io"
 	"math/rand"
 	"sort"
 	"sync"
@@ -9,8 +10,9 @@ import (
 	"github.com/Div9851/new-warehouse-sim/agentaction"
 	"github.com/Div9851/new-warehouse-sim/agentstate"
 	"github.com/Div9851/new-warehouse-sim/config"
-	"github.com/Div9851/new-warehouse-sim/fduct"
 	"github.com/Div9851/new-warehouse-sim/mapdata"
+	"github.com/Div9851/new-warehouse-sim/policy"
+	"github.com/Div9851/new-warehouse-sim/trajectory"
 )
 
 type Request struct {
@@ -18,27 +20,67 @@ type Request struct {
 	Pos  mapdata.Pos
 }
 
+// Exchange は荷物交換で Pos のアイテムの担当が From から To に移ったこと
+type Exchange struct {
+	From int
+	To   int
+	Pos  mapdata.Pos
+}
+
 var dummyRequest = Request{
 	From: -1,
 	Pos:  mapdata.NonePos,
 }
 
 type Simulator struct {
-	Turn        int
-	States      agentstate.States
-	Items       []map[mapdata.Pos]int
-	LastActions agentaction.Actions
-	ItemsCount  []int
-	PickUpCount []int
-	ClearCount  []int
-	MapData     *mapdata.MapData
-	SimRandGen  *rand.Rand
-	RandGens    []*rand.Rand
-	Config      *config.Config
-	Verbose     bool
+	Turn          int
+	States        agentstate.States
+	Items         []map[mapdata.Pos]int
+	LastActions   agentaction.Actions
+	LastExchanges []Exchange // 直前の Step で行った荷物交換
+	LastRewards   []float64
+	LastSpawns    []mapdata.Pos // 直前のターンに新しく出現したアイテムの位置 (出現しなかったエージェントは NonePos)
+	ItemsCount    []int
+	PickUpCount   []int
+	ClearCount    []int
+	IterCount     []int // Policy が IterationReporter の場合の探索の反復回数の合計
+	Metrics       *Metrics
+	MapData       *mapdata.MapData
+	SimRandGen    *rand.Rand
+	RandGens      []*rand.Rand // Policy が使う、エージェントごとの乱数生成器
+	ExchRandGen   *rand.Rand   // 荷物交換の RANDOM 戦略が使う乱数生成器
+	Policy        policy.Policy
+	Config        *config.Config
+	Verbose       bool
+	Trace         io.Writer            // nil でない場合、各ターンの状態を 1 行ずつ書き出す
+	Recorder      *trajectory.Recorder // nil でない場合、各ターンの記録を書き出す
 }
 
-func New(mapData *mapdata.MapData, config *config.Config, verbose bool, seed int64) *Simulator {
+// Check は config が正しく、mapData の上で実行できるかどうかを確かめる
+func Check(mapData *mapdata.MapData, config *config.Config) error {
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid config (%s)", err)
+	}
+	// 開始位置は互いに異なるセルから選ぶ
+	if config.NumAgents > len(mapData.AllPos) {
+		return fmt.Errorf("can't place %d agents on %d free cells", config.NumAgents, len(mapData.AllPos))
+	}
+	// アイテムは SpawnPos から選ぶ
+	if len(agentstate.SpawnPos(mapData, config)) == 0 {
+		return fmt.Errorf("no cell to spawn items (shelfPickOnly needs cells next to a shelf)")
+	}
+	if config.BatteryEnabled() && len(mapData.ChargerPositions) == 0 {
+		return fmt.Errorf("no charging station for the battery model")
+	}
+	return nil
+}
+
+// New は config.Policy で選んだ Policy を使うシミュレータを構築する
+// 独自の Policy を使う場合は、構築後に Policy を差し替えるか policy.Register で登録する
+func New(mapData *mapdata.MapData, config *config.Config, verbose bool, seed int64) (*Simulator, error) {
+	if err := Check(mapData, config); err != nil {
+		return nil, err
+	}
 	simRandGen := rand.New(rand.NewSource(seed))
 	randGens := []*rand.Rand{}
 	states := agentstate.States{}
@@ -55,15 +97,22 @@ func New(mapData *mapdata.MapData, config *config.Config, verbose bool, seed int
 		}
 		usedPos[startPos] = struct{}{}
 		newState := agentstate.State{
-			Pos:     startPos,
-			HasItem: false,
+			Pos:      startPos,
+			NumItems: 0,
+			Battery:  config.BatteryCapacity,
 		}
 		states = append(states, newState)
 		items = append(items, make(map[mapdata.Pos]int))
 	}
+	// Policy の乱数消費の仕方が荷物交換の結果に影響しないように、別の系列を使う
+	exchRandGen := rand.New(rand.NewSource(simRandGen.Int63()))
 	itemsCount := make([]int, config.NumAgents)
 	pickUpCount := make([]int, config.NumAgents)
 	clearCount := make([]int, config.NumAgents)
+	agentPolicy, err := policy.New(config.Policy, mapData, config, randGens)
+	if err != nil {
+		return nil, err
+	}
 	return &Simulator{
 		Turn:        0,
 		States:      states,
@@ -71,169 +120,201 @@ func New(mapData *mapdata.MapData, config *config.Config, verbose bool, seed int
 		ItemsCount:  itemsCount,
 		PickUpCount: pickUpCount,
 		ClearCount:  clearCount,
+		IterCount:   make([]int, config.NumAgents),
+		Metrics:     NewMetrics(config.NumAgents),
 		MapData:     mapData,
 		SimRandGen:  simRandGen,
 		RandGens:    randGens,
+		ExchRandGen: exchRandGen,
+		Policy:      agentPolicy,
 		Config:      config,
 		Verbose:     verbose,
-	}
+	}, nil
 }
 
 func (sim *Simulator) Run() ([]int, []int, []int) {
-	var nodePool = &sync.Pool{
-		New: func() interface{} {
-			return fduct.NewNode()
-		},
-	}
 	for {
 		if sim.Verbose {
 			sim.Dump()
 		}
+		if sim.Trace != nil {
+			sim.WriteTrace(sim.Trace)
+		}
 		if sim.Turn == sim.Config.LastTurn {
+			if sim.Recorder != nil {
+				sim.Recorder.Record(sim.frame(nil))
+			}
 			break
 		}
-		depotPos := sim.MapData.DepotPos
-		minDist := sim.MapData.MinDist
-		// 荷物交換
-		if sim.Config.EnableExchange {
-			load := make([]float64, sim.Config.NumAgents)
-			avgLoad := 0.0
-			for id := 0; id < sim.Config.NumAgents; id++ {
-				if sim.States[id].HasItem {
-					pos := sim.States[id].Pos
-					load[id] += float64(minDist[depotPos.R][depotPos.C][pos.R][pos.C])
-				}
-				for pos, cnt := range sim.Items[id] {
-					load[id] += float64(minDist[depotPos.R][depotPos.C][pos.R][pos.C] * cnt)
-				}
-				avgLoad += load[id]
+		sim.Step()
+	}
+	return sim.ItemsCount, sim.PickUpCount, sim.ClearCount
+}
+
+// Step は荷物交換、各エージェントの行動決定、行動の実行を行い、1 ターン進める
+func (sim *Simulator) Step() {
+	sim.LastExchanges = nil
+	if sim.Config.EnableExchange {
+		sim.LastExchanges = sim.Exchange()
+		sim.Metrics.observeExchanges(sim.LastExchanges, sim.States, sim.MapData)
+	}
+	var frame *trajectory.Frame
+	if sim.Recorder != nil {
+		frame = sim.frame(sim.LastExchanges)
+	}
+	// プランニングフェーズ
+	actions := make(agentaction.Actions, sim.Config.NumAgents)
+	var wg sync.WaitGroup
+	for id := 0; id < sim.Config.NumAgents; id++ {
+		wg.Add(1)
+		go func(id int) {
+			actions[id] = sim.Policy.Decide(sim.Turn, id, sim.States, sim.Items)
+			if reporter, ok := sim.Policy.(policy.IterationReporter); ok {
+				sim.IterCount[id] += reporter.LastIterations(id)
 			}
-			avgLoad /= float64(sim.Config.NumAgents)
-			var requests []Request
-			acceptIds := make(map[Request][]int)
-			for id := 0; id < sim.Config.NumAgents; id++ {
-				if load[id] > avgLoad {
-					limit := load[id] - avgLoad
-					cands := []mapdata.Pos{}
-					for pos := range sim.Items[id] {
-						dist := float64(minDist[depotPos.R][depotPos.C][pos.R][pos.C])
-						if dist <= limit {
-							cands = append(cands, pos)
-						}
-					}
-					if len(cands) == 0 {
-						continue
-					}
-					sort.Slice(cands, func(i, j int) bool {
-						d1 := minDist[depotPos.R][depotPos.C][cands[i].R][cands[i].C]
-						d2 := minDist[depotPos.R][depotPos.C][cands[j].R][cands[j].C]
-						return d1 < d2
-					})
-					switch sim.Config.RequestStrategy {
-					case "NEAREST_FROM_DEPOT":
-						requests = append(requests, Request{
-							From: id,
-							Pos:  cands[0],
-						})
-					case "FARTHEST_FROM_DEPOT":
-						requests = append(requests, Request{
-							From: id,
-							Pos:  cands[len(cands)-1],
-						})
-					case "RANDOM":
-						requests = append(requests, Request{
-							From: id,
-							Pos:  cands[sim.RandGens[id].Intn(len(cands))],
-						})
-					}
+			wg.Done()
+		}(id)
+	}
+	wg.Wait()
+	sim.Next(actions)
+	if frame != nil {
+		sim.completeFrame(frame)
+		sim.Recorder.Record(frame)
+	}
+}
+
+// Exchange は担当するアイテムの配置から求めた負荷が平均に近づくように、エージェント間でアイテムの担当を移す
+// 行った交換を返す
+func (sim *Simulator) Exchange() []Exchange {
+	depotDist := sim.MapData.DepotDist
+	var exchanges []Exchange
+	load := make([]float64, sim.Config.NumAgents)
+	avgLoad := 0.0
+	for id := 0; id < sim.Config.NumAgents; id++ {
+		if sim.States[id].NumItems > 0 {
+			pos := sim.States[id].Pos
+			load[id] += float64(depotDist[pos.R][pos.C])
+		}
+		for pos, cnt := range sim.Items[id] {
+			load[id] += float64(depotDist[pos.R][pos.C] * cnt)
+		}
+		avgLoad += load[id]
+	}
+	avgLoad /= float64(sim.Config.NumAgents)
+	var requests []Request
+	acceptIds := make(map[Request][]int)
+	for id := 0; id < sim.Config.NumAgents; id++ {
+		if load[id] > avgLoad {
+			limit := load[id] - avgLoad
+			cands := []mapdata.Pos{}
+			for pos := range sim.Items[id] {
+				dist := float64(depotDist[pos.R][pos.C])
+				if dist <= limit {
+					cands = append(cands, pos)
 				}
 			}
-			for id := 0; id < sim.Config.NumAgents; id++ {
-				if load[id] < avgLoad {
-					limit := avgLoad - load[id]
-					cands := []Request{}
-					for _, req := range requests {
-						dist := float64(minDist[depotPos.R][depotPos.C][req.Pos.R][req.Pos.C])
-						if dist <= limit {
-							cands = append(cands, req)
-						}
-					}
-					if len(cands) == 0 {
-						continue
-					}
-					sort.Slice(cands, func(i, j int) bool {
-						d1 := minDist[depotPos.R][depotPos.C][cands[i].Pos.R][cands[i].Pos.C]
-						d2 := minDist[depotPos.R][depotPos.C][cands[j].Pos.R][cands[j].Pos.C]
-						return d1 < d2
-					})
-					switch sim.Config.AcceptStrategy {
-					case "NEAREST_FROM_DEPOT":
-						acceptIds[cands[0]] = append(acceptIds[cands[0]], id)
-					case "FARTHEST_FROM_DEPOT":
-						acceptIds[cands[len(cands)-1]] = append(acceptIds[cands[len(cands)-1]], id)
-					case "RANDOM":
-						r := sim.RandGens[id].Intn(len(cands))
-						acceptIds[cands[r]] = append(acceptIds[cands[r]], id)
-					}
-				}
+			if len(cands) == 0 {
+				continue
 			}
-			for _, req := range requests {
-				cands := acceptIds[req]
-				if len(cands) == 0 {
-					continue
+			// 距離が等しい場合は位置の順に並べ、map の反復順によらない順序にする
+			sort.Slice(cands, func(i, j int) bool {
+				d1 := depotDist[cands[i].R][cands[i].C]
+				d2 := depotDist[cands[j].R][cands[j].C]
+				if d1 != d2 {
+					return d1 < d2
 				}
-				sort.Slice(cands, func(i, j int) bool {
-					return load[cands[i]] < load[cands[j]]
+				return cands[i].Less(cands[j])
+			})
+			switch sim.Config.RequestStrategy {
+			case config.NearestFromDepot:
+				requests = append(requests, Request{
+					From: id,
+					Pos:  cands[0],
+				})
+			case config.FarthestFromDepot:
+				requests = append(requests, Request{
+					From: id,
+					Pos:  cands[len(cands)-1],
+				})
+			case config.RandomItem:
+				requests = append(requests, Request{
+					From: id,
+					Pos:  cands[sim.ExchRandGen.Intn(len(cands))],
 				})
-				from := req.From
-				to := -1
-				switch sim.Config.NominateStrategy {
-				case "LOWEST_LOAD":
-					to = cands[0]
-				case "HIGHEST_LOAD":
-					to = cands[len(cands)-1]
-				case "RANDOM":
-					to = cands[sim.RandGens[from].Intn(len(cands))]
-				}
-				sim.ItemsCount[from]--
-				sim.ItemsCount[to]++
-				sim.Items[from][req.Pos]--
-				if sim.Items[from][req.Pos] == 0 {
-					delete(sim.Items[from], req.Pos)
-				}
-				sim.Items[to][req.Pos]++
 			}
 		}
-		// プランニングフェーズ
-		planners := make([]*fduct.Planner, sim.Config.NumAgents)
-		actions := make(agentaction.Actions, sim.Config.NumAgents)
-		var wg sync.WaitGroup
-		for id := 0; id < sim.Config.NumAgents; id++ {
-			wg.Add(1)
-			planners[id] = fduct.New(sim.MapData, sim.Config, sim.RandGens[id], nodePool, 0)
-			go func(id int) {
-				for iter := 0; iter < sim.Config.NumIters; iter++ {
-					planners[id].Update(sim.Turn, sim.States, sim.Items, iter)
+	}
+	for id := 0; id < sim.Config.NumAgents; id++ {
+		if load[id] < avgLoad {
+			limit := avgLoad - load[id]
+			cands := []Request{}
+			for _, req := range requests {
+				dist := float64(depotDist[req.Pos.R][req.Pos.C])
+				if dist <= limit {
+					cands = append(cands, req)
 				}
-				actions[id], _ = planners[id].GetBestAction(id, sim.States[id], sim.Items[id])
-				planners[id].Free()
-				wg.Done()
-			}(id)
+			}
+			if len(cands) == 0 {
+				continue
+			}
+			sort.SliceStable(cands, func(i, j int) bool {
+				d1 := depotDist[cands[i].Pos.R][cands[i].Pos.C]
+				d2 := depotDist[cands[j].Pos.R][cands[j].Pos.C]
+				return d1 < d2
+			})
+			switch sim.Config.AcceptStrategy {
+			case config.NearestFromDepot:
+				acceptIds[cands[0]] = append(acceptIds[cands[0]], id)
+			case config.FarthestFromDepot:
+				acceptIds[cands[len(cands)-1]] = append(acceptIds[cands[len(cands)-1]], id)
+			case config.RandomItem:
+				r := sim.ExchRandGen.Intn(len(cands))
+				acceptIds[cands[r]] = append(acceptIds[cands[r]], id)
+			}
 		}
-		wg.Wait()
-		sim.Next(actions)
 	}
-	return sim.ItemsCount, sim.PickUpCount, sim.ClearCount
+	for _, req := range requests {
+		cands := acceptIds[req]
+		if len(cands) == 0 {
+			continue
+		}
+		sort.SliceStable(cands, func(i, j int) bool {
+			return load[cands[i]] < load[cands[j]]
+		})
+		from := req.From
+		to := -1
+		switch sim.Config.NominateStrategy {
+		case config.LowestLoad:
+			to = cands[0]
+		case config.HighestLoad:
+			to = cands[len(cands)-1]
+		case config.RandomAgent:
+			to = cands[sim.ExchRandGen.Intn(len(cands))]
+		}
+		sim.ItemsCount[from]--
+		sim.ItemsCount[to]++
+		sim.Items[from][req.Pos]--
+		if sim.Items[from][req.Pos] == 0 {
+			delete(sim.Items[from], req.Pos)
+		}
+		sim.Items[to][req.Pos]++
+		exchanges = append(exchanges, Exchange{From: from, To: to, Pos: req.Pos})
+	}
+	return exchanges
 }
 
 func (sim *Simulator) Next(actions agentaction.Actions) {
 	sim.Turn++
 	sim.LastActions = actions
 	ignore := make([]bool, sim.Config.NumAgents)
-	nxtStates, _, newItem := agentstate.Next(sim.States, actions, ignore, sim.Items, sim.MapData, sim.Config, sim.SimRandGen, sim.Config.NewItemProb)
+	curStates := sim.States
+	nxtStates, rewards, spawns, collisions := agentstate.Next(sim.States, actions, ignore, sim.Items, sim.MapData, sim.Config, sim.SimRandGen, sim.Config.NewItemProb)
 	sim.States = nxtStates
+	sim.LastRewards = rewards
+	sim.LastSpawns = spawns
+	sim.Metrics.observeTurn(sim.Turn-1, curStates, nxtStates, actions, spawns, collisions)
 	for i := 0; i < sim.Config.NumAgents; i++ {
-		if newItem[i] {
+		if spawns[i] != mapdata.NonePos {
 			sim.ItemsCount[i]++
 		}
 		// PICKUP や CLEAR は可能なときにしか選ばないと仮定
@@ -241,11 +322,72 @@ func (sim *Simulator) Next(actions agentaction.Actions) {
 			sim.PickUpCount[i]++
 		}
 		if actions[i] == agentaction.CLEAR {
-			sim.ClearCount[i]++
+			sim.ClearCount[i] += curStates[i].NumItems
 		}
 	}
 }
 
+// frame は荷物交換の後、行動する前の現在の状態を記録する Frame を作る
+func (sim *Simulator) frame(exchanges []Exchange) *trajectory.Frame {
+	frame := &trajectory.Frame{
+		Turn:   sim.Turn,
+		States: append(agentstate.States{}, sim.States...),
+		Items:  trajectory.ItemsOf(sim.Items),
+	}
+	for _, exchange := range exchanges {
+		frame.Exchanges = append(frame.Exchanges, trajectory.Exchange{From: exchange.From, To: exchange.To, Pos: exchange.Pos})
+	}
+	return frame
+}
+
+// completeFrame は Next で進めたターンの行動、報酬、出現したアイテムを frame に加える
+func (sim *Simulator) completeFrame(frame *trajectory.Frame) {
+	for _, action := range sim.LastActions {
+		frame.Actions = append(frame.Actions, action.ToStr())
+	}
+	frame.Rewards = sim.LastRewards
+	for i, pos := range sim.LastSpawns {
+		if pos != mapdata.NonePos {
+			frame.Spawns = append(frame.Spawns, trajectory.Spawn{Agent: i, Pos: pos})
+		}
+	}
+}
+
+// WriteTrace は現在のターンの状態と直前の行動を 1 行で w に書き出す
+// 同じ (マップ, 設定, シード) の実行が同じ軌跡をたどるかどうかを比べるために使う
+func (sim *Simulator) WriteTrace(w io.Writer) {
+	actions := make([]string, len(sim.LastActions))
+	for i, action := range sim.LastActions {
+		actions[i] = action.ToStr()
+	}
+	// fmt は map をキーの順に書き出すので、Items の表記は反復順によらない
+	fmt.Fprintf(w, "%d %v %v %v\n", sim.Turn, actions, sim.States, sim.Items)
+}
+
+// agentGlyphs はマップ上でエージェントを表す文字で、0-9, a-z, A-Z のうち
+// マップのセルに使う文字 (一方通行の 'v'、充電ステーションの 'C' など) を除いたもの
+var agentGlyphs = func() []byte {
+	var glyphs []byte
+	for _, r := range [][2]byte{{'0', '9'}, {'a', 'z'}, {'A', 'Z'}} {
+		for c := r[0]; c <= r[1]; c++ {
+			if !mapdata.IsCell(c) {
+				glyphs = append(glyphs, c)
+			}
+		}
+	}
+	return glyphs
+}()
+
+// AgentGlyph はマップ上でエージェント id を表す文字を返す
+// agentGlyphs を使い切った後 (id >= 58) のエージェントは全て '@' で表すので、
+// 区別するには Dump のエージェントごとの位置か TUI の色を使う
+func AgentGlyph(id int) byte {
+	if id < len(agentGlyphs) {
+		return agentGlyphs[id]
+	}
+	return '@'
+}
+
 func (sim *Simulator) Dump() {
 	fmt.Printf("TURN %d:\n", sim.Turn)
 	mapData := [][]byte{}
@@ -253,7 +395,7 @@ func (sim *Simulator) Dump() {
 		mapData = append(mapData, []byte(row))
 	}
 	for i, agent := range sim.States {
-		mapData[agent.Pos.R][agent.Pos.C] = byte('0' + i)
+		mapData[agent.Pos.R][agent.Pos.C] = AgentGlyph(i)
 	}
 	for _, row := range mapData {
 		fmt.Println(string(row))
@@ -261,11 +403,14 @@ func (sim *Simulator) Dump() {
 	fmt.Println("[ITEMS]")
 	fmt.Printf("%v\n", sim.Items)
 	for i, state := range sim.States {
-		fmt.Printf("[AGENT %d]\n", i)
+		fmt.Printf("[AGENT %d] %c\n", i, AgentGlyph(i))
 		if len(sim.LastActions) > 0 {
 			fmt.Printf("last action: %s\n", sim.LastActions[i].ToStr())
 		}
 		fmt.Printf("pos: %v\n", state.Pos)
+		if sim.Config.BatteryEnabled() {
+			fmt.Printf("battery: %d/%d\n", state.Battery, sim.Config.BatteryCapacity)
+		}
 		fmt.Printf("items count: %d ", sim.ItemsCount[i])
 		fmt.Printf("pickup count: %d ", sim.PickUpCount[i])
 		fmt.Printf("clear count: %d\n", sim.ClearCount[i])
@@ -0,0 +1,25 @@
+package sim
+
+import (
+	"testing"
+
+	"github.com/Div9851/new-warehouse-sim/mapdata"
+)
+
+// エージェントの文字がマップのセルの文字や他のエージェントの文字と紛れないことを確かめる
+func TestAgentGlyph(t *testing.T) {
+	seen := make(map[byte]int)
+	for id := 0; id < len(agentGlyphs); id++ {
+		glyph := AgentGlyph(id)
+		if mapdata.IsCell(glyph) {
+			t.Errorf("glyph %q of agent %d is a map cell", glyph, id)
+		}
+		if other, ok := seen[glyph]; ok {
+			t.Errorf("agents %d and %d share glyph %q", other, id, glyph)
+		}
+		seen[glyph] = id
+	}
+	if glyph := AgentGlyph(len(agentGlyphs)); glyph != '@' {
+		t.Errorf("glyph of agent %d is %q, want '@'", len(agentGlyphs), glyph)
+	}
+}
@@ -0,0 +1,247 @@
+package stats
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Welford は値を 1 つずつ加えながら、Welford の方法で平均と分散を数値的に安定に求める
+type Welford struct {
+	n    int
+	mean float64
+	m2   float64 // 平均からの偏差の二乗和
+}
+
+// Of は s の値を全て加えた Welford を返す
+func Of(s []float64) *Welford {
+	w := &Welford{}
+	for _, x := range s {
+		w.Add(x)
+	}
+	return w
+}
+
+func (w *Welford) Add(x float64) {
+	w.n++
+	delta := x - w.mean
+	w.mean += delta / float64(w.n)
+	w.m2 += delta * (x - w.mean)
+}
+
+func (w *Welford) N() int {
+	return w.n
+}
+
+func (w *Welford) Mean() float64 {
+	if w.n == 0 {
+		return math.NaN()
+	}
+	return w.mean
+}
+
+// Var は母分散 (n で割った分散) を返す
+func (w *Welford) Var() float64 {
+	if w.n == 0 {
+		return math.NaN()
+	}
+	return w.m2 / float64(w.n)
+}
+
+// SampleVar は不偏分散 (n-1 で割った分散) を返す
+// 値が 2 つ未満の場合は NaN を返す
+func (w *Welford) SampleVar() float64 {
+	if w.n < 2 {
+		return math.NaN()
+	}
+	return w.m2 / float64(w.n-1)
+}
+
+// StdErr は平均の標準誤差を返す
+func (w *Welford) StdErr() float64 {
+	return math.Sqrt(w.SampleVar() / float64(w.n))
+}
+
+// TInterval は t 分布に基づく平均の信頼水準 level の信頼区間を返す
+func (w *Welford) TInterval(level float64) (float64, float64) {
+	if w.n < 2 {
+		return math.NaN(), math.NaN()
+	}
+	half := TQuantile(0.5+level/2, float64(w.n-1)) * w.StdErr()
+	return w.mean - half, w.mean + half
+}
+
+// Bootstrap は s から numResamples 回の復元抽出を行い、パーセンタイル法による平均の信頼水準 level の信頼区間を返す
+func Bootstrap(s []float64, level float64, numResamples int, randGen *rand.Rand) (float64, float64) {
+	if len(s) == 0 || numResamples <= 0 {
+		return math.NaN(), math.NaN()
+	}
+	means := make([]float64, numResamples)
+	for k := range means {
+		var sum float64
+		for range s {
+			sum += s[randGen.Intn(len(s))]
+		}
+		means[k] = sum / float64(len(s))
+	}
+	sort.Float64s(means)
+	return percentile(means, (1-level)/2), percentile(means, (1+level)/2)
+}
+
+// percentile は昇順に並んだ sorted の p 分位点を線形補間で求める
+func percentile(sorted []float64, p float64) float64 {
+	pos := p * float64(len(sorted)-1)
+	i := int(math.Floor(pos))
+	if i+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	frac := pos - float64(i)
+	return sorted[i]*(1-frac) + sorted[i+1]*frac
+}
+
+// PairedTest は対応のある 2 群の差 (b - a) についての t 検定の結果
+type PairedTest struct {
+	N        int
+	MeanDiff float64
+	StdErr   float64
+	T        float64
+	DF       float64
+	P        float64 // 両側の p 値
+	CILow    float64
+	CIHigh   float64
+}
+
+// PairedT は a[i] と b[i] を対にして、差の平均が 0 であるかを t 検定する
+func PairedT(a []float64, b []float64, level float64) (PairedTest, error) {
+	if len(a) != len(b) {
+		return PairedTest{}, fmt.Errorf("can't pair %d values with %d values", len(a), len(b))
+	}
+	if len(a) < 2 {
+		return PairedTest{}, fmt.Errorf("need at least 2 pairs but got %d", len(a))
+	}
+	w := &Welford{}
+	for i := range a {
+		w.Add(b[i] - a[i])
+	}
+	test := PairedTest{
+		N:        w.N(),
+		MeanDiff: w.Mean(),
+		StdErr:   w.StdErr(),
+		DF:       float64(w.N() - 1),
+	}
+	test.CILow, test.CIHigh = w.TInterval(level)
+	if test.StdErr == 0 {
+		// 全ての差が等しい場合
+		test.T = math.Copysign(math.Inf(1), test.MeanDiff)
+		test.P = 0
+		if test.MeanDiff == 0 {
+			test.T, test.P = 0, 1
+		}
+		return test, nil
+	}
+	test.T = test.MeanDiff / test.StdErr
+	test.P = 2 * (1 - TCDF(math.Abs(test.T), test.DF))
+	return test, nil
+}
+
+// TCDF は自由度 df の t 分布の累積分布関数の t での値を返す
+func TCDF(t float64, df float64) float64 {
+	var tail float64
+	if t*t < df {
+		// t が 0 に近いと df / (df + t^2) が 1 に丸められるので、I_x(a, b) = 1 - I_{1-x}(b, a) を使う
+		tail = 0.5 - 0.5*regIncBeta(0.5, df/2, t*t/(df+t*t))
+	} else {
+		tail = 0.5 * regIncBeta(df/2, 0.5, df/(df+t*t))
+	}
+	if t > 0 {
+		return 1 - tail
+	}
+	return tail
+}
+
+// TQuantile は自由度 df の t 分布の p 分位点を二分法で求める
+func TQuantile(p float64, df float64) float64 {
+	lo, hi := -1.0, 1.0
+	for TCDF(lo, df) > p {
+		lo *= 2
+	}
+	for TCDF(hi, df) < p {
+		hi *= 2
+	}
+	for k := 0; k < 200 && hi-lo > 1e-12; k++ {
+		mid := (lo + hi) / 2
+		if TCDF(mid, df) < p {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return (lo + hi) / 2
+}
+
+// regIncBeta は正則化された不完全ベータ関数 I_x(a, b) を連分数展開で求める
+func regIncBeta(a float64, b float64, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	lga, _ := math.Lgamma(a)
+	lgb, _ := math.Lgamma(b)
+	lgab, _ := math.Lgamma(a + b)
+	front := math.Exp(lgab - lga - lgb + a*math.Log(x) + b*math.Log(1-x))
+	// 連分数が速く収束する側で計算する
+	if x < (a+1)/(a+b+2) {
+		return front * betaCF(a, b, x) / a
+	}
+	return 1 - front*betaCF(b, a, 1-x)/b
+}
+
+// betaCF は不完全ベータ関数の連分数を修正 Lentz 法で求める
+func betaCF(a float64, b float64, x float64) float64 {
+	const (
+		maxIter = 300
+		eps     = 1e-15
+		tiny    = 1e-300
+	)
+	qab, qap, qam := a+b, a+1, a-1
+	c, d := 1.0, 1-qab*x/qap
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+	for m := 1; m <= maxIter; m++ {
+		fm := float64(m)
+		m2 := 2 * fm
+		aa := fm * (b - fm) * x / ((qam + m2) * (a + m2))
+		d = 1 + aa*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + aa/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		h *= d * c
+		aa = -(a + fm) * (qab + fm) * x / ((a + m2) * (qap + m2))
+		d = 1 + aa*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + aa/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		del := d * c
+		h *= del
+		if math.Abs(del-1) < eps {
+			break
+		}
+	}
+	return h
+}
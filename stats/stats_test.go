@@ -0,0 +1,163 @@
+package stats
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func near(a float64, b float64, tol float64) bool {
+	return math.Abs(a-b) <= tol
+}
+
+// 自由度 1, 2, 4 の t 分布は累積分布関数が閉じた式で書けるので、それと比べる
+func TestTCDFClosedForm(t *testing.T) {
+	closed := map[float64]func(x float64) float64{
+		1: func(x float64) float64 { return 0.5 + math.Atan(x)/math.Pi },
+		2: func(x float64) float64 { return 0.5 + x/(2*math.Sqrt(2+x*x)) },
+		4: func(x float64) float64 {
+			u := 1 + x*x/4
+			return 0.5 + 0.375*x/math.Sqrt(u)*(1-x*x/(12*u))
+		},
+	}
+	for df, cdf := range closed {
+		for _, x := range []float64{-30, -4, -1.5, -0.3, 0, 0.3, 1.5, 4, 30} {
+			if got, want := TCDF(x, df), cdf(x); !near(got, want, 1e-12) {
+				t.Errorf("TCDF(%v, %v) = %v, want %v", x, df, got, want)
+			}
+		}
+	}
+}
+
+// t 分布表の値と比べる
+func TestTQuantile(t *testing.T) {
+	for _, c := range []struct {
+		p, df, want float64
+	}{
+		{0.975, 1, 12.706204736},
+		{0.975, 4, 2.776445105},
+		{0.975, 9, 2.262157163},
+		{0.975, 30, 2.042272456},
+		{0.95, 5, 2.015048373},
+		{0.995, 10, 3.169272673},
+		{0.5, 7, 0},
+		{0.51, 7, 0.025977942},
+		{0.025, 9, -2.262157163},
+	} {
+		if got := TQuantile(c.p, c.df); !near(got, c.want, 1e-8) {
+			t.Errorf("TQuantile(%v, %v) = %.10f, want %.9f", c.p, c.df, got, c.want)
+		}
+	}
+}
+
+func TestPairedT(t *testing.T) {
+	// 差は 1, 2, 2, 0, 2 で、平均 1.4、不偏分散 0.8、標準誤差 0.4、t = 3.5 (自由度 4)
+	a := []float64{1, 2, 3, 4, 5}
+	b := []float64{2, 4, 5, 4, 7}
+	test, err := PairedT(a, b, 0.95)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if test.N != 5 || test.DF != 4 {
+		t.Errorf("N = %d, DF = %v, want 5, 4", test.N, test.DF)
+	}
+	for _, c := range []struct {
+		name      string
+		got, want float64
+	}{
+		{"MeanDiff", test.MeanDiff, 1.4},
+		{"StdErr", test.StdErr, 0.4},
+		{"T", test.T, 3.5},
+		{"P", test.P, 0.0248961634602},
+		{"CILow", test.CILow, 1.4 - 2.7764451052*0.4},
+		{"CIHigh", test.CIHigh, 1.4 + 2.7764451052*0.4},
+	} {
+		if !near(c.got, c.want, 1e-9) {
+			t.Errorf("%s = %.12f, want %.12f", c.name, c.got, c.want)
+		}
+	}
+}
+
+// 全ての差が等しく標準誤差が 0 の場合
+func TestPairedTZeroStdErr(t *testing.T) {
+	for _, c := range []struct {
+		a, b  []float64
+		wantT float64
+		wantP float64
+	}{
+		{[]float64{1, 2, 3}, []float64{2, 3, 4}, math.Inf(1), 0},
+		{[]float64{1, 2, 3}, []float64{0, 1, 2}, math.Inf(-1), 0},
+		{[]float64{1, 2, 3}, []float64{1, 2, 3}, 0, 1},
+	} {
+		test, err := PairedT(c.a, c.b, 0.95)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.T != c.wantT || test.P != c.wantP {
+			t.Errorf("PairedT(%v, %v): T = %v, P = %v, want %v, %v", c.a, c.b, test.T, test.P, c.wantT, c.wantP)
+		}
+		if test.CILow != test.MeanDiff || test.CIHigh != test.MeanDiff {
+			t.Errorf("PairedT(%v, %v): CI [%v, %v], want [%v, %v]", c.a, c.b, test.CILow, test.CIHigh, test.MeanDiff, test.MeanDiff)
+		}
+	}
+}
+
+func TestPairedTErrors(t *testing.T) {
+	if _, err := PairedT([]float64{1, 2}, []float64{1}, 0.95); err == nil {
+		t.Error("PairedT with unequal lengths succeeded")
+	}
+	if _, err := PairedT([]float64{1}, []float64{2}, 0.95); err == nil {
+		t.Error("PairedT with 1 pair succeeded")
+	}
+}
+
+// 大きな値に小さなばらつきが乗っている場合も、2 パスで求めた分散と一致することを確かめる
+func TestWelfordMatchesTwoPass(t *testing.T) {
+	randGen := rand.New(rand.NewSource(1))
+	for _, offset := range []float64{0, 1e6} {
+		s := make([]float64, 1000)
+		for i := range s {
+			s[i] = offset + randGen.NormFloat64()
+		}
+		var sum float64
+		for _, x := range s {
+			sum += x
+		}
+		mean := sum / float64(len(s))
+		var ss float64
+		for _, x := range s {
+			ss += (x - mean) * (x - mean)
+		}
+		w := Of(s)
+		if !near(w.Mean(), mean, 1e-9*math.Max(1, math.Abs(mean))) {
+			t.Errorf("offset %v: Mean = %v, want %v", offset, w.Mean(), mean)
+		}
+		if want := ss / float64(len(s)); !near(w.Var(), want, 1e-9*want) {
+			t.Errorf("offset %v: Var = %v, want %v", offset, w.Var(), want)
+		}
+		if want := ss / float64(len(s)-1); !near(w.SampleVar(), want, 1e-9*want) {
+			t.Errorf("offset %v: SampleVar = %v, want %v", offset, w.SampleVar(), want)
+		}
+	}
+	if w := Of([]float64{5}); !math.IsNaN(w.SampleVar()) || w.Var() != 0 {
+		t.Errorf("single value: Var = %v, SampleVar = %v, want 0, NaN", w.Var(), w.SampleVar())
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	randGen := rand.New(rand.NewSource(1))
+	if lo, hi := Bootstrap([]float64{3, 3, 3}, 0.95, 100, randGen); lo != 3 || hi != 3 {
+		t.Errorf("constant values: [%v, %v], want [3, 3]", lo, hi)
+	}
+	s := make([]float64, 200)
+	for i := range s {
+		s[i] = randGen.NormFloat64()
+	}
+	w := Of(s)
+	lo, hi := Bootstrap(s, 0.95, 2000, randGen)
+	tlo, thi := w.TInterval(0.95)
+	// 正規分布の標本では、パーセンタイル法の区間は t 分布に基づく区間に近い
+	if !(lo < w.Mean() && w.Mean() < hi) || !near(lo, tlo, 0.05) || !near(hi, thi, 0.05) {
+		t.Errorf("Bootstrap = [%v, %v], want close to t interval [%v, %v]", lo, hi, tlo, thi)
+	}
+}
@@ -0,0 +1,81 @@
+package trajectory
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+
+	"github.com/Div9851/new-warehouse-sim/agentaction"
+	"github.com/Div9851/new-warehouse-sim/agentstate"
+	"github.com/Div9851/new-warehouse-sim/mapdata"
+)
+
+// Verify は記録された行動を agentstate.Next で再生し、各ターンの状態、アイテム、報酬が記録と一致するかどうかを確かめる
+// アイテムの出現と荷物交換は乱数を使わずに記録のとおりに再現する
+// mapData は header.Map から作ったもの
+func Verify(header *Header, frames []*Frame, mapData *mapdata.MapData) error {
+	if len(frames) == 0 {
+		return fmt.Errorf("no frames")
+	}
+	config := header.Config
+	states := frames[0].States
+	items := make([]map[mapdata.Pos]int, len(states))
+	for i := range items {
+		items[i] = make(map[mapdata.Pos]int)
+	}
+	// 乱数は使わないが Next に渡す必要がある
+	randGen := rand.New(rand.NewSource(0))
+	for k, frame := range frames {
+		if frame.Turn != frames[0].Turn+k {
+			return fmt.Errorf("turn %d: expected turn %d", frame.Turn, frames[0].Turn+k)
+		}
+		for _, exchange := range frame.Exchanges {
+			if exchange.From < 0 || exchange.From >= len(items) || exchange.To < 0 || exchange.To >= len(items) {
+				return fmt.Errorf("turn %d: exchange between unknown agents %d and %d", frame.Turn, exchange.From, exchange.To)
+			}
+			if items[exchange.From][exchange.Pos] == 0 {
+				return fmt.Errorf("turn %d: agent %d has no item at %v to exchange", frame.Turn, exchange.From, exchange.Pos)
+			}
+			items[exchange.From][exchange.Pos]--
+			if items[exchange.From][exchange.Pos] == 0 {
+				delete(items[exchange.From], exchange.Pos)
+			}
+			items[exchange.To][exchange.Pos]++
+		}
+		if !reflect.DeepEqual(states, frame.States) {
+			return fmt.Errorf("turn %d: states %v differ from the log %v", frame.Turn, states, frame.States)
+		}
+		if got := ItemsOf(items); !reflect.DeepEqual(got, frame.Items) {
+			return fmt.Errorf("turn %d: items %v differ from the log %v", frame.Turn, got, frame.Items)
+		}
+		if frame.Actions == nil {
+			if k != len(frames)-1 {
+				return fmt.Errorf("turn %d: missing actions", frame.Turn)
+			}
+			break
+		}
+		if len(frame.Actions) != len(states) {
+			return fmt.Errorf("turn %d: %d actions for %d agents", frame.Turn, len(frame.Actions), len(states))
+		}
+		actions := make(agentaction.Actions, len(states))
+		for i, name := range frame.Actions {
+			action, ok := agentaction.FromStr(name)
+			if !ok {
+				return fmt.Errorf("turn %d: unknown action %q", frame.Turn, name)
+			}
+			actions[i] = action
+		}
+		nxtStates, rewards, _, _ := agentstate.Next(states, actions, make([]bool, len(states)), items, mapData, config, randGen, 0)
+		if !reflect.DeepEqual(rewards, frame.Rewards) {
+			return fmt.Errorf("turn %d: rewards %v differ from the log %v", frame.Turn, rewards, frame.Rewards)
+		}
+		for _, spawn := range frame.Spawns {
+			if spawn.Agent < 0 || spawn.Agent >= len(items) {
+				return fmt.Errorf("turn %d: item spawned for unknown agent %d", frame.Turn, spawn.Agent)
+			}
+			items[spawn.Agent][spawn.Pos]++
+		}
+		states = nxtStates
+	}
+	return nil
+}
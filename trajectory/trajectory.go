@@ -0,0 +1,152 @@
+package trajectory
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/Div9851/new-warehouse-sim/agentstate"
+	"github.com/Div9851/new-warehouse-sim/config"
+	"github.com/Div9851/new-warehouse-sim/mapdata"
+)
+
+// 軌跡の記録は 1 行に 1 つの JSON を書く形式 (JSON Lines) で、
+// 1 行目が Header、2 行目以降が各ターンの Frame になる
+// 最後の Frame は最終ターンの状態で、Actions を持たない
+
+// Header は記録した実行の条件
+type Header struct {
+	Map    []string       `json:"map"`
+	Config *config.Config `json:"config"`
+	Seed   int64          `json:"seed"`
+}
+
+// Item は pos にある count 個のアイテム
+type Item struct {
+	Pos   mapdata.Pos `json:"pos"`
+	Count int         `json:"count"`
+}
+
+// Exchange は荷物交換でアイテムの担当が From から To に移ったこと
+type Exchange struct {
+	From int         `json:"from"`
+	To   int         `json:"to"`
+	Pos  mapdata.Pos `json:"pos"`
+}
+
+// Spawn はエージェント Agent の担当するアイテムが Pos に出現したこと
+type Spawn struct {
+	Agent int         `json:"agent"`
+	Pos   mapdata.Pos `json:"pos"`
+}
+
+// Frame は 1 ターン分の記録
+// States と Items は荷物交換の後、行動する前のもの
+type Frame struct {
+	Turn      int               `json:"turn"`
+	Exchanges []Exchange        `json:"exchanges,omitempty"`
+	States    agentstate.States `json:"states"`
+	Items     [][]Item          `json:"items"`
+	Actions   []string          `json:"actions,omitempty"`
+	Rewards   []float64         `json:"rewards,omitempty"`
+	Spawns    []Spawn           `json:"spawns,omitempty"`
+}
+
+// ItemsOf はエージェントごとのアイテムの表を、位置の順に並べたリストにする
+func ItemsOf(items []map[mapdata.Pos]int) [][]Item {
+	list := make([][]Item, len(items))
+	for i := range items {
+		list[i] = []Item{}
+		for pos, count := range items[i] {
+			list[i] = append(list[i], Item{Pos: pos, Count: count})
+		}
+		sort.Slice(list[i], func(a, b int) bool {
+			return list[i][a].Pos.Less(list[i][b].Pos)
+		})
+	}
+	return list
+}
+
+// ItemMaps は ItemsOf の逆変換
+func ItemMaps(list [][]Item) []map[mapdata.Pos]int {
+	items := make([]map[mapdata.Pos]int, len(list))
+	for i := range list {
+		items[i] = make(map[mapdata.Pos]int)
+		for _, item := range list[i] {
+			items[i][item.Pos] += item.Count
+		}
+	}
+	return items
+}
+
+// Recorder は軌跡を w に書き出す
+// 実行中の軌跡を読めるように、各行はバッファせずにそのまま書き出す
+// 書き込みのエラーは最初の 1 つだけを覚えておき、Close で返す
+type Recorder struct {
+	enc *json.Encoder
+	err error
+}
+
+func NewRecorder(w io.Writer, header *Header) *Recorder {
+	rec := &Recorder{
+		enc: json.NewEncoder(w),
+	}
+	rec.write(header)
+	return rec
+}
+
+func (rec *Recorder) write(v interface{}) {
+	if rec.err != nil {
+		return
+	}
+	rec.err = rec.enc.Encode(v)
+}
+
+func (rec *Recorder) Record(frame *Frame) {
+	rec.write(frame)
+}
+
+// Close はそれまでに起きた書き込みのエラーを返す
+func (rec *Recorder) Close() error {
+	return rec.err
+}
+
+// Read は r から軌跡の記録を読み込む
+func Read(r io.Reader) (*Header, []*Frame, error) {
+	scanner := bufio.NewScanner(r)
+	// マップの行を含むので長い行を許す
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	var header *Header
+	var frames []*Frame
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var err error
+		if header == nil {
+			header = &Header{}
+			err = json.Unmarshal(scanner.Bytes(), header)
+		} else {
+			frame := &Frame{}
+			err = json.Unmarshal(scanner.Bytes(), frame)
+			frames = append(frames, frame)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %s", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if header == nil {
+		return nil, nil, fmt.Errorf("empty trajectory")
+	}
+	if header.Config == nil {
+		return nil, nil, fmt.Errorf("line 1: missing config")
+	}
+	return header, frames, nil
+}